@@ -0,0 +1,125 @@
+package goblet
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Access log formats that can be passed to NewAccessLogger.
+const (
+	// AccessLogFormatCombined writes the Apache combined log format, followed
+	// by the Goblet fields as key="value" pairs.
+	AccessLogFormatCombined = "combined"
+
+	// AccessLogFormatJSON writes one JSON object per line.
+	AccessLogFormatJSON = "json"
+)
+
+type accessLogEntry struct {
+	Time           time.Time `json:"time"`
+	RemoteAddr     string    `json:"remote_addr"`
+	Method         string    `json:"method"`
+	URI            string    `json:"uri"`
+	Proto          string    `json:"proto"`
+	Status         int       `json:"status"`
+	RequestSize    int64     `json:"request_size"`
+	ResponseSize   int64     `json:"response_size"`
+	LatencyMS      int64     `json:"latency_ms"`
+	UserAgent      string    `json:"user_agent,omitempty"`
+	Principal      string    `json:"principal"`
+	CISource       string    `json:"ci_source,omitempty"`
+	Repository     string    `json:"repository,omitempty"`
+	CacheState     string    `json:"cache_state,omitempty"`
+	UpstreamWaitMS int64     `json:"upstream_wait_ms"`
+}
+
+// NewAccessLogger returns a RequestLogger writing one line per request to w,
+// in the given format. Only successSampleRatio of the successful requests are
+// logged, so that the errors stand out of a busy server's traffic; the failed
+// requests are always logged.
+func NewAccessLogger(w io.Writer, format string, successSampleRatio float64) (func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration), error) {
+	var encode func(*accessLogEntry) ([]byte, error)
+	switch format {
+	case AccessLogFormatCombined:
+		encode = encodeCombinedLog
+	case AccessLogFormatJSON:
+		encode = func(e *accessLogEntry) ([]byte, error) {
+			return json.Marshal(e)
+		}
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+
+	var mu sync.Mutex
+	return func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration) {
+		if status < http.StatusBadRequest && successSampleRatio < 1 && rand.Float64() >= successSampleRatio {
+			return
+		}
+
+		info := RequestInfoFromContext(r.Context())
+		remoteAddr, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			remoteAddr = r.RemoteAddr
+		}
+		bs, err := encode(&accessLogEntry{
+			Time:           time.Now().Add(-latency),
+			RemoteAddr:     remoteAddr,
+			Method:         r.Method,
+			URI:            r.URL.RequestURI(),
+			Proto:          r.Proto,
+			Status:         status,
+			RequestSize:    requestSize,
+			ResponseSize:   responseSize,
+			LatencyMS:      latency.Milliseconds(),
+			UserAgent:      r.UserAgent(),
+			Principal:      info.Principal,
+			CISource:       info.CISource,
+			Repository:     info.Repository,
+			CacheState:     info.CacheState,
+			UpstreamWaitMS: info.UpstreamWait.Milliseconds(),
+		})
+		if err != nil {
+			Logger(LogServer).Error("Cannot encode an access log entry", "err", err)
+			return
+		}
+		bs = append(bs, '\n')
+
+		mu.Lock()
+		defer mu.Unlock()
+		if _, err := w.Write(bs); err != nil {
+			Logger(LogServer).Error("Cannot write an access log entry", "err", err)
+		}
+	}, nil
+}
+
+func encodeCombinedLog(e *accessLogEntry) ([]byte, error) {
+	// The parsers of the combined format expect "-" for the requests
+	// without an authenticated user.
+	authUser := cmp.Or(e.Principal, "-")
+	if authUser == AnonymousPrincipal {
+		authUser = "-"
+	}
+	// The request size is not part of the combined format.
+	return fmt.Appendf(nil, "%s - %s [%s] %s %d %d \"-\" %s ci_source=%s repository=%s cache_state=%s upstream_wait_ms=%d latency_ms=%d",
+		e.RemoteAddr,
+		authUser,
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(e.Method+" "+e.URI+" "+e.Proto),
+		e.Status,
+		e.ResponseSize,
+		strconv.Quote(e.UserAgent),
+		strconv.Quote(e.CISource),
+		strconv.Quote(e.Repository),
+		strconv.Quote(e.CacheState),
+		e.UpstreamWaitMS,
+		e.LatencyMS,
+	), nil
+}
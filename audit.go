@@ -0,0 +1,247 @@
+package goblet
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.opencensus.io/tag"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// AnonymousPrincipal is the principal of the requests whose authorizer didn't
+// identify the client.
+const AnonymousPrincipal = "anonymous"
+
+// AuditEntry records one ls-refs or fetch command served to a client.
+type AuditEntry struct {
+	Time        time.Time `json:"time"`
+	Principal   string    `json:"principal"`
+	CISource    string    `json:"ci_source,omitempty"`
+	Repository  string    `json:"repository"`
+	Command     string    `json:"command"`
+	Wants       int       `json:"wants,omitempty"`
+	BytesServed int64     `json:"bytes_served"`
+	CacheState  string    `json:"cache_state"`
+	Status      string    `json:"status"`
+	DurationMS  int64     `json:"duration_ms"`
+}
+
+type requestState struct {
+	mu           sync.Mutex
+	principal    string
+	ciSource     string
+	repository   string
+	cacheState   string
+	upstreamWait time.Duration
+}
+
+type requestStateKey struct{}
+
+func withRequestState(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestStateKey{}, &requestState{})
+}
+
+// SetPrincipal records who the request authorizer authenticated the request
+// as, e.g. "oidc:repo:canva/goblet:ref:refs/heads/main". It is meant to be
+// called by RequestAuthorizer implementations.
+func SetPrincipal(r *http.Request, principal string) {
+	if s, ok := r.Context().Value(requestStateKey{}).(*requestState); ok {
+		s.mu.Lock()
+		s.principal = principal
+		s.mu.Unlock()
+	}
+}
+
+// PrincipalFromContext returns the principal set by the request authorizer,
+// or AnonymousPrincipal.
+func PrincipalFromContext(ctx context.Context) string {
+	if s, ok := ctx.Value(requestStateKey{}).(*requestState); ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.principal != "" {
+			return s.principal
+		}
+	}
+	return AnonymousPrincipal
+}
+
+// RequestInfo is what was learnt about a request while serving it.
+type RequestInfo struct {
+	Principal string
+	CISource  string
+
+	// Repository is the canonical upstream URL of the repository.
+	Repository string
+
+	// CacheState is the cache state of the last Git command of the request,
+	// e.g. "locally-served" or "queried-upstream".
+	CacheState string
+
+	// UpstreamWait is the time spent waiting for upstream fetches.
+	UpstreamWait time.Duration
+}
+
+// RequestInfoFromContext returns what was learnt about the request of ctx so
+// far. It is meant to be called by RequestLogger implementations.
+func RequestInfoFromContext(ctx context.Context) RequestInfo {
+	info := RequestInfo{Principal: PrincipalFromContext(ctx)}
+	if s, ok := ctx.Value(requestStateKey{}).(*requestState); ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		info.CISource = s.ciSource
+		info.Repository = s.repository
+		info.CacheState = s.cacheState
+		info.UpstreamWait = s.upstreamWait
+	}
+	return info
+}
+
+func updateRequestState(ctx context.Context, f func(*requestState)) {
+	if s, ok := ctx.Value(requestStateKey{}).(*requestState); ok {
+		s.mu.Lock()
+		f(s)
+		s.mu.Unlock()
+	}
+}
+
+// CredentialFingerprint identifies a credential in logs without revealing it.
+func CredentialFingerprint(credential string) string {
+	sum := sha256.Sum256([]byte(credential))
+	return hex.EncodeToString(sum[:8])
+}
+
+// auditingReporter completes an AuditEntry with the outcome of the command
+// it reports.
+type auditingReporter struct {
+	reporter gitProtocolErrorReporter
+	entry    *AuditEntry
+}
+
+func (a *auditingReporter) reportError(ctx context.Context, startTime time.Time, err error) {
+	code := codes.Internal
+	if st, ok := status.FromError(err); ok {
+		code = st.Code()
+	}
+	a.entry.Status = code.String()
+	if m := tag.FromContext(ctx); m != nil {
+		a.entry.CacheState, _ = m.Value(CommandCacheStateKey)
+	}
+	a.reporter.reportError(ctx, startTime, err)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// NewJSONAuditLogger returns an audit logger writing one JSON object per line
+// to w.
+func NewJSONAuditLogger(w io.Writer) func(*AuditEntry) {
+	var mu sync.Mutex
+	return func(entry *AuditEntry) {
+		bs, err := json.Marshal(entry)
+		if err != nil {
+			Logger(LogServer).Error("Cannot encode an audit entry", "err", err)
+			return
+		}
+		bs = append(bs, '\n')
+
+		mu.Lock()
+		defer mu.Unlock()
+		if _, err := w.Write(bs); err != nil {
+			Logger(LogServer).Error("Cannot write an audit entry", "err", err)
+		}
+	}
+}
+
+// RotatingFile is a file that is rotated once it exceeds a size. Up to
+// maxBackups rotated files are kept, as path.1 (the most recent), path.2, and
+// so on.
+type RotatingFile struct {
+	path       string
+	maxBytes   int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// NewRotatingFile opens path for appending.
+func NewRotatingFile(path string, maxBytes int64, maxBackups int) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := r.openLocked(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.size > 0 && r.size+int64(len(p)) > r.maxBytes {
+		if err := r.rotateLocked(); err != nil {
+			Logger(LogServer).Error("Cannot rotate the file", "path", r.path, "err", err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+func (r *RotatingFile) openLocked() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = fi.Size()
+	return nil
+}
+
+// rotateLocked always leaves a file open to write to, the current one if the
+// rotation failed.
+func (r *RotatingFile) rotateLocked() error {
+	r.f.Close()
+	var err error
+	if r.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxBackups))
+		for i := r.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		err = os.Rename(r.path, r.path+".1")
+	} else {
+		err = os.Remove(r.path)
+	}
+	if openErr := r.openLocked(); err == nil {
+		err = openErr
+	}
+	return err
+}
@@ -0,0 +1,195 @@
+package goblet
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync/atomic"
+	"time"
+
+	"github.com/ReneKroon/ttlcache/v2"
+)
+
+const (
+	DefaultAuthCacheTTL          = 15 * time.Minute
+	DefaultAuthCacheNegativeTTL  = time.Minute
+	DefaultAuthCacheStaleIfError = time.Hour
+	DefaultAuthCacheSize         = 1000 * 1000
+)
+
+// AuthDecision is a cached authorization decision.
+type AuthDecision struct {
+	Authorized bool      `json:"authorized"`
+	DecidedAt  time.Time `json:"decided_at"`
+}
+
+// AuthCache stores authorization decisions. Keys never hold credentials; see
+// AuthDecisionCache. Implementations backed by a shared store let replicas
+// reuse each other's decisions.
+type AuthCache interface {
+	Get(key string) (AuthDecision, bool)
+
+	// Set stores a decision, which may be dropped after ttl.
+	Set(key string, decision AuthDecision, ttl time.Duration)
+}
+
+// MemoryAuthCache is an in-process AuthCache.
+type MemoryAuthCache struct {
+	cache *ttlcache.Cache
+}
+
+// NewMemoryAuthCache returns a MemoryAuthCache holding up to size decisions.
+// A zero size falls back to DefaultAuthCacheSize.
+func NewMemoryAuthCache(size int) *MemoryAuthCache {
+	if size == 0 {
+		size = DefaultAuthCacheSize
+	}
+	cache := ttlcache.NewCache()
+	cache.SkipTTLExtensionOnHit(true) // set this to true so that TTL won't get extended on cache hit
+	cache.SetCacheSizeLimit(size)
+	return &MemoryAuthCache{cache: cache}
+}
+
+func (c *MemoryAuthCache) Get(key string) (AuthDecision, bool) {
+	v, err := c.cache.Get(key)
+	if err != nil {
+		return AuthDecision{}, false
+	}
+	return v.(AuthDecision), true
+}
+
+func (c *MemoryAuthCache) Set(key string, decision AuthDecision, ttl time.Duration) {
+	c.cache.SetWithTTL(key, decision, ttl)
+}
+
+// Len returns the number of decisions currently held.
+func (c *MemoryAuthCache) Len() int {
+	return c.cache.Count()
+}
+
+// Evictions returns the number of decisions ever removed, either expired or
+// evicted.
+func (c *MemoryAuthCache) Evictions() int64 {
+	return c.cache.GetMetrics().Evicted
+}
+
+func (c *MemoryAuthCache) Close() {
+	c.cache.Close()
+}
+
+// AuthDecisionCache caches the decisions of an authorizer that validates
+// credentials against an upstream. Cache keys are derived from the credential
+// and the repository with HMAC-SHA256, so that credentials don't sit in the
+// cache. Positive and negative decisions expire after PositiveTTL and
+// NegativeTTL respectively. When the upstream cannot be reached, a positive
+// decision keeps being used for up to StaleIfError after it expired.
+type AuthDecisionCache struct {
+	Store        AuthCache
+	PositiveTTL  time.Duration
+	NegativeTTL  time.Duration
+	StaleIfError time.Duration
+
+	hashKey []byte
+
+	hits      int64
+	misses    int64
+	inserts   int64
+	staleHits int64
+}
+
+// AuthDecisionCacheMetrics are the counters of an AuthDecisionCache.
+type AuthDecisionCacheMetrics struct {
+	Hits      int64
+	Misses    int64
+	Inserts   int64
+	StaleHits int64
+}
+
+// NewAuthDecisionCache returns an AuthDecisionCache. Replicas sharing a store
+// must share hashKey too; if it is empty, a random key is generated. Zero
+// durations fall back to the defaults.
+func NewAuthDecisionCache(store AuthCache, hashKey []byte, positiveTTL, negativeTTL, staleIfError time.Duration) *AuthDecisionCache {
+	if len(hashKey) == 0 {
+		hashKey = make([]byte, 32)
+		if _, err := rand.Read(hashKey); err != nil {
+			panic(err)
+		}
+	}
+	if positiveTTL == 0 {
+		positiveTTL = DefaultAuthCacheTTL
+	}
+	if negativeTTL == 0 {
+		negativeTTL = DefaultAuthCacheNegativeTTL
+	}
+	if staleIfError == 0 {
+		staleIfError = DefaultAuthCacheStaleIfError
+	}
+	return &AuthDecisionCache{
+		Store:        store,
+		PositiveTTL:  positiveTTL,
+		NegativeTTL:  negativeTTL,
+		StaleIfError: staleIfError,
+		hashKey:      hashKey,
+	}
+}
+
+// Authorize returns the cached decision for credential and repoURL, or the one
+// made by validate. validate returns whether the credential is authorized,
+// whether the decision can be cached, i.e. the upstream actually made it, and
+// the associated error.
+func (c *AuthDecisionCache) Authorize(credential, repoURL string, validate func() (bool, bool, error)) (bool, error) {
+	key := c.key(credential, repoURL)
+	now := time.Now()
+
+	cached, ok := c.Store.Get(key)
+	if ok {
+		ttl := c.NegativeTTL
+		if cached.Authorized {
+			ttl = c.PositiveTTL
+		}
+		if now.Sub(cached.DecidedAt) < ttl {
+			atomic.AddInt64(&c.hits, 1)
+			// return the cached result. We will lose the original error if any
+			return cached.Authorized, nil
+		}
+	}
+	atomic.AddInt64(&c.misses, 1)
+
+	authorized, cacheable, err := validate()
+	if !cacheable {
+		if ok && cached.Authorized && now.Sub(cached.DecidedAt) < c.PositiveTTL+c.StaleIfError {
+			atomic.AddInt64(&c.staleHits, 1)
+			Logger(LogAuth).Warn("Using a stale authorization decision", "repo", repoURL, "decided_at", cached.DecidedAt, "err", err)
+			return true, nil
+		}
+		return authorized, err
+	}
+
+	ttl := c.NegativeTTL
+	if authorized {
+		// Positive decisions are kept longer to be served while the
+		// upstream is unavailable.
+		ttl = c.PositiveTTL + c.StaleIfError
+	}
+	c.Store.Set(key, AuthDecision{Authorized: authorized, DecidedAt: now}, ttl)
+	atomic.AddInt64(&c.inserts, 1)
+	return authorized, err
+}
+
+func (c *AuthDecisionCache) key(credential, repoURL string) string {
+	mac := hmac.New(sha256.New, c.hashKey)
+	mac.Write([]byte(credential))
+	mac.Write([]byte{0})
+	mac.Write([]byte(repoURL))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (c *AuthDecisionCache) Metrics() AuthDecisionCacheMetrics {
+	return AuthDecisionCacheMetrics{
+		Hits:      atomic.LoadInt64(&c.hits),
+		Misses:    atomic.LoadInt64(&c.misses),
+		Inserts:   atomic.LoadInt64(&c.inserts),
+		StaleHits: atomic.LoadInt64(&c.staleHits),
+	}
+}
@@ -0,0 +1,137 @@
+package goblet
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gitprotocolio"
+)
+
+// BundlePathPrefix is the path under which pre-generated clone bundles are
+// served. GitHub owners cannot start with an underscore, so this never
+// shadows a proxied repository.
+const BundlePathPrefix = "/_goblet/bundles/"
+
+// BundleHandler returns a handler that serves the clone bundles stored under
+// ServerConfig.BundleDir. Range requests are supported so that clients can
+// resume interrupted downloads. The requests are authorized by
+// ServerConfig.RequestAuthorizer, as if they were fetching the repository of
+// the bundle.
+func BundleHandler(config *ServerConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, BundlePathPrefix))
+		host, repoPath, ok := strings.Cut(strings.TrimPrefix(name, "/"), "/")
+		if config.BundleDir == "" || !ok || !strings.HasSuffix(repoPath, ".bundle") {
+			http.NotFound(w, r)
+			return
+		}
+
+		// The bundle of "<host>/<path>.bundle" is the one of the
+		// repository "https://<host>/<path>".
+		authzReq := r.Clone(r.Context())
+		authzReq.URL = &url.URL{Scheme: "https", Host: host, Path: "/" + strings.TrimSuffix(repoPath, ".bundle")}
+		authzReq.Host = host
+		if err := config.RequestAuthorizer(authzReq); err != nil {
+			reporter := &httpErrorReporter{config: config, req: r, w: w}
+			reporter.reportError(err)
+			return
+		}
+
+		f, err := os.Open(filepath.Join(config.BundleDir, filepath.FromSlash(name)))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+
+		fi, err := f.Stat()
+		if err != nil || fi.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-git-bundle")
+		http.ServeContent(w, r, name, fi.ModTime(), f)
+	})
+}
+
+func bundleFilePath(config *ServerConfig, u *url.URL) string {
+	return filepath.Join(config.BundleDir, u.Host, u.Path+".bundle")
+}
+
+// hasBundle tells whether a clone bundle can be advertised for the given
+// canonical upstream URL.
+func hasBundle(config *ServerConfig, u *url.URL) bool {
+	if config.BundleDir == "" || config.BundleURL == "" {
+		return false
+	}
+	_, err := os.Stat(bundleFilePath(config, u))
+	return err == nil
+}
+
+func (r *managedRepository) bundleURIResponse() []*gitprotocolio.ProtocolV2ResponseChunk {
+	chunks := []*gitprotocolio.ProtocolV2ResponseChunk{}
+	if hasBundle(r.config, r.upstreamURL) {
+		uri := strings.TrimSuffix(r.config.BundleURL, "/") + BundlePathPrefix + path.Join(r.upstreamURL.Host, r.upstreamURL.Path) + ".bundle"
+		chunks = append(chunks,
+			&gitprotocolio.ProtocolV2ResponseChunk{Response: []byte("bundle.version=1\n")},
+			&gitprotocolio.ProtocolV2ResponseChunk{Response: []byte("bundle.mode=all\n")},
+			&gitprotocolio.ProtocolV2ResponseChunk{Response: []byte("bundle.goblet.uri=" + uri + "\n")},
+		)
+	}
+	return append(chunks, &gitprotocolio.ProtocolV2ResponseChunk{EndResponse: true})
+}
+
+// updateBundle regenerates the clone bundle of the repository, unless the
+// existing one is younger than ServerConfig.BundleMaxAge. The bundle is
+// written next to its final location and renamed, so that readers never see
+// a partial file.
+func (r *managedRepository) updateBundle() (err error) {
+	if r.config.BundleDir == "" {
+		return nil
+	}
+	if !atomic.CompareAndSwapInt32(&r.bundling, 0, 1) {
+		r.logger().Debug("UpdateBundle skipped since another one is running")
+		return nil
+	}
+	defer atomic.StoreInt32(&r.bundling, 0)
+
+	bundlePath := bundleFilePath(r.config, r.upstreamURL)
+	if fi, err := os.Stat(bundlePath); err == nil && time.Since(fi.ModTime()) < r.config.BundleMaxAge {
+		return nil
+	}
+
+	startTime := time.Now()
+	defer r.logElapsed("updateBundle", startTime, 10*time.Minute)
+
+	if err := os.MkdirAll(filepath.Dir(bundlePath), 0750); err != nil {
+		return fmt.Errorf("cannot create the bundle dir: %v", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(bundlePath), ".tmp-bundle-")
+	if err != nil {
+		return fmt.Errorf("cannot create a temporary bundle: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	err = r.WriteBundle(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), bundlePath)
+	}
+
+	if err != nil {
+		r.logger().Error("UpdateBundle failed", "err", err)
+	} else {
+		r.logger().Info("UpdateBundle succeeded", "duration", time.Since(startTime))
+	}
+	return err
+}
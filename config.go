@@ -16,7 +16,63 @@ package goblet
 
 import (
 	"encoding/json"
+	"fmt"
+	"log/slog"
 	"os"
+	"strings"
+)
+
+// Request authorizers that can be selected with ConfigFile.RequestAuthorizer.
+const (
+	// RequestAuthorizerNone accepts every request.
+	RequestAuthorizerNone = "none"
+
+	// RequestAuthorizerGitHub validates the client's GitHub token against
+	// the requested repository.
+	RequestAuthorizerGitHub = "github"
+
+	// RequestAuthorizerStatic accepts the tokens listed in
+	// ConfigFile.StaticTokensFile.
+	RequestAuthorizerStatic = "static"
+
+	// RequestAuthorizerUpstream replays the client's credential against
+	// the upstream repository. It works with any Git hosting provider.
+	RequestAuthorizerUpstream = "upstream"
+
+	// RequestAuthorizerOIDC validates the client's OIDC token and allows
+	// the repositories of the ConfigFile.OIDC rules matching its claims.
+	RequestAuthorizerOIDC = "oidc"
+)
+
+// PackObjectsHookBuiltin as ConfigFile.PackObjectsHook makes goblet-server run
+// itself as the pack-objects hook, instead of a separate binary.
+const PackObjectsHookBuiltin = "builtin"
+
+// Metrics exporters that can be selected with ConfigFile.MetricsExporter.
+const (
+	// MetricsExporterDatadog sends the metrics to the local Datadog agent.
+	MetricsExporterDatadog = "datadog"
+
+	// MetricsExporterPrometheus serves the metrics on /metrics.
+	MetricsExporterPrometheus = "prometheus"
+)
+
+// Trace exporters that can be selected with TracingConfig.Exporter.
+const (
+	// TraceExporterOTLP sends the spans to an OTLP/HTTP collector.
+	TraceExporterOTLP = "otlp"
+
+	// TraceExporterStdout writes the spans to stdout.
+	TraceExporterStdout = "stdout"
+)
+
+// Log formats that can be selected with ConfigFile.LogFormat.
+const (
+	// LogFormatJSON writes the logs as JSON lines.
+	LogFormatJSON = "json"
+
+	// LogFormatText writes the logs as key=value lines.
+	LogFormatText = "text"
 )
 
 // ConfigFile holds the configuration for Goblet server instances.
@@ -25,9 +81,171 @@ type ConfigFile struct {
 	CacheRoot               string   `json:"cache_root"`
 	TokenExpiryDeltaSeconds int      `json:"token_expiry_delta_seconds"`
 	EnableMetrics           bool     `json:"enable_metrics,omitempty"`
+	MetricsExporter         string   `json:"metrics_exporter,omitempty"`
+	StatsdAddress           string   `json:"statsd_address,omitempty"`
+	GitBinary               string   `json:"git_binary,omitempty"`
 	PackObjectsHook         string   `json:"pack_objects_hook,omitempty"`
 	PackObjectsCache        string   `json:"pack_objects_cache,omitempty"`
 	Repositories            []string `json:"repositories,omitempty"`
+	Peers                   []string `json:"peers,omitempty"`
+	BundleDir               string   `json:"bundle_dir,omitempty"`
+	BundleURL               string   `json:"bundle_url,omitempty"`
+	BundleMaxAgeSeconds     int      `json:"bundle_max_age_seconds,omitempty"`
+	RequestAuthorizer       string   `json:"request_authorizer,omitempty"`
+	StaticTokensFile        string   `json:"static_tokens_file,omitempty"`
+
+	// UpstreamHosts are the hosts (e.g. "gitlab.example.com") of the
+	// repositories that the upstream request authorizer checks the client's
+	// credential against. The requests for the other hosts are denied. It
+	// must be set if RequestAuthorizer is "upstream".
+	UpstreamHosts []string `json:"upstream_hosts,omitempty"`
+
+	// AdminAddress is the address (e.g. ":8081") of the listener serving the
+	// endpoints meant for the sibling replicas only, which don't authorize
+	// requests: it must not be reachable by the clients. The Peers are the
+	// base URLs of the admin listeners of the sibling replicas.
+	AdminAddress string `json:"admin_address,omitempty"`
+
+	// The pack-objects cache is cleaned every minute, evicting the entries
+	// older than PackObjectsCacheMaxAgeSeconds, then the least recently
+	// served ones until it holds at most PackObjectsCacheMaxSizeMB. They
+	// default to a day and 10 GiB, and a negative value disables either
+	// limit. The entries being written for longer than
+	// PackObjectsCacheStaleTimeoutSeconds are purged, two hours if zero.
+	PackObjectsCacheMaxSizeMB           int `json:"pack_objects_cache_max_size_mb,omitempty"`
+	PackObjectsCacheMaxAgeSeconds       int `json:"pack_objects_cache_max_age_seconds,omitempty"`
+	PackObjectsCacheStaleTimeoutSeconds int `json:"pack_objects_cache_stale_timeout_seconds,omitempty"`
+
+	// The decisions of the github and upstream request authorizers are
+	// cached for AuthCacheTTLSeconds when positive, and for
+	// AuthCacheNegativeTTLSeconds when negative. A positive decision keeps
+	// being used for AuthCacheStaleIfErrorSeconds after it expired, while
+	// the upstream is unreachable. Cache keys are HMACs keyed with the
+	// content of AuthCacheHashKeyFile, or with a random key if unset.
+	AuthCacheTTLSeconds          int    `json:"auth_cache_ttl_seconds,omitempty"`
+	AuthCacheNegativeTTLSeconds  int    `json:"auth_cache_negative_ttl_seconds,omitempty"`
+	AuthCacheStaleIfErrorSeconds int    `json:"auth_cache_stale_if_error_seconds,omitempty"`
+	AuthCacheSize                int    `json:"auth_cache_size,omitempty"`
+	AuthCacheHashKeyFile         string `json:"auth_cache_hash_key_file,omitempty"`
+
+	// CredentialPassthrough makes ls-refs and on-demand fetches use the
+	// client's own token upstream. It requires the github or upstream
+	// request authorizer, which confirm the client's access to the
+	// repository.
+	CredentialPassthrough bool `json:"credential_passthrough,omitempty"`
+
+	// OIDC configures the oidc request authorizer.
+	OIDC *OIDCConfig `json:"oidc,omitempty"`
+
+	// AuditLog is where the audit log is written as JSON lines, either
+	// "stdout" or a file path. Files are rotated once they exceed
+	// AuditLogMaxSizeMB (100 by default), keeping AuditLogMaxBackups.
+	AuditLog           string `json:"audit_log,omitempty"`
+	AuditLogMaxSizeMB  int    `json:"audit_log_max_size_mb,omitempty"`
+	AuditLogMaxBackups int    `json:"audit_log_max_backups,omitempty"`
+
+	// AccessLog is where one line per request is written, either "stdout"
+	// or a file path rotated like the audit log. AccessLogFormat is
+	// "combined" (the default) or "json". Only AccessLogSuccessSampleRatio
+	// of the successful requests are logged, 1 if unset.
+	AccessLog                   string  `json:"access_log,omitempty"`
+	AccessLogFormat             string  `json:"access_log_format,omitempty"`
+	AccessLogSuccessSampleRatio float64 `json:"access_log_success_sample_ratio,omitempty"`
+	AccessLogMaxSizeMB          int     `json:"access_log_max_size_mb,omitempty"`
+	AccessLogMaxBackups         int     `json:"access_log_max_backups,omitempty"`
+
+	// /readyz fails when a pre-fetched repository hasn't been updated for
+	// ReadinessMaxStalenessSeconds (3600 if unset), or when less than
+	// ReadinessMinFreeDiskMB (1024 if unset) are free in the cache root.
+	// Zero disables either check.
+	ReadinessMaxStalenessSeconds *int `json:"readiness_max_staleness_seconds,omitempty"`
+	ReadinessMinFreeDiskMB       *int `json:"readiness_min_free_disk_mb,omitempty"`
+
+	// TLS makes Goblet serve HTTPS instead of plain HTTP.
+	TLS *TLSConfig `json:"tls,omitempty"`
+
+	// Tracing exports the trace spans of the requests.
+	Tracing *TracingConfig `json:"tracing,omitempty"`
+
+	// LogFormat is the format of the logs written to stderr, json by
+	// default. LogLevel is the minimum level of the logs ("debug", "info",
+	// "warn" or "error"), overridden per subsystem (e.g. "repository" or
+	// "github") by LogLevels.
+	LogFormat string                `json:"log_format,omitempty"`
+	LogLevel  slog.Level            `json:"log_level,omitempty"`
+	LogLevels map[string]slog.Level `json:"log_levels,omitempty"`
+
+	// GitHubURL and GitHubAPIURL point Goblet to a GitHub Enterprise
+	// Server instead of github.com. GitHubAPIURL defaults to the "/api/v3"
+	// path of GitHubURL.
+	GitHubURL    string `json:"github_url,omitempty"`
+	GitHubAPIURL string `json:"github_api_url,omitempty"`
+
+	// GitHubInstallations routes repositories to GitHub App installations
+	// other than the one in GH_APP_INSTALLATION_ID. The first matching
+	// rule wins. With DiscoverGitHubInstallations, the installation of the
+	// repositories matching no rule is looked up through the GitHub API
+	// instead, and their fetches fail if it cannot be found.
+	GitHubInstallations         []GitHubInstallationRule `json:"github_installations,omitempty"`
+	DiscoverGitHubInstallations bool                     `json:"discover_github_installations,omitempty"`
+}
+
+// GitHubInstallationRule maps the repositories matching Pattern (a
+// path.Match pattern against "<owner>/<repo>", matched case-insensitively) to
+// a GitHub App installation.
+type GitHubInstallationRule struct {
+	Pattern        string `json:"pattern"`
+	InstallationID string `json:"installation_id"`
+}
+
+// OIDCConfig configures the validation of OIDC tokens. The key set is read
+// from JWKSFile, or fetched from JWKSURL.
+type OIDCConfig struct {
+	Issuer   string     `json:"issuer"`
+	Audience string     `json:"audience"`
+	JWKSFile string     `json:"jwks_file,omitempty"`
+	JWKSURL  string     `json:"jwks_url,omitempty"`
+	Rules    []OIDCRule `json:"rules"`
+}
+
+// OIDCRule allows the tokens whose claims match the Claims patterns to fetch
+// the Repositories, "<host>/<path>" patterns that can refer to string claims
+// as "{name}", e.g. "github.com/{repository}".
+type OIDCRule struct {
+	Claims       map[string]string `json:"claims"`
+	Repositories []string          `json:"repositories"`
+}
+
+// TracingConfig configures the export of trace spans, either to the OTLP/HTTP
+// collector at Endpoint (e.g. "otel-collector:4318"), or to stdout.
+// SampleRatio is the ratio of the traces started by Goblet that are sampled,
+// 1 if unset. The traces started by clients follow their sampling decision.
+type TracingConfig struct {
+	Exporter    string  `json:"exporter"`
+	Endpoint    string  `json:"endpoint,omitempty"`
+	Insecure    bool    `json:"insecure,omitempty"`
+	SampleRatio float64 `json:"sample_ratio,omitempty"`
+}
+
+// TLSConfig configures the HTTPS listener. The certificate and key are
+// reloaded when they change on disk. Setting ClientCAFile enables client
+// certificates; the requests made with a certificate matching one of the
+// ClientCertificateRules are authorized by these rules instead of the
+// request authorizer.
+type TLSConfig struct {
+	CertFile               string                        `json:"cert_file"`
+	KeyFile                string                        `json:"key_file"`
+	ClientCAFile           string                        `json:"client_ca_file,omitempty"`
+	RequireClientCert      bool                          `json:"require_client_cert,omitempty"`
+	ClientCertificateRules []ClientCertificateRuleConfig `json:"client_certificate_rules,omitempty"`
+}
+
+// ClientCertificateRuleConfig allows the client certificates whose subject
+// matches Subject (e.g. "CN=ci-*,O=Canva") to fetch the Repositories
+// ("<host>/<path>" patterns).
+type ClientCertificateRuleConfig struct {
+	Subject      string   `json:"subject"`
+	Repositories []string `json:"repositories"`
 }
 
 // LoadConfigFile reads a Goblet configuration file.
@@ -37,6 +255,121 @@ func LoadConfigFile(path string) (ConfigFile, error) {
 	if err != nil {
 		return file, err
 	}
-	err = json.Unmarshal(bytes, &file)
-	return file, err
+	if err = json.Unmarshal(bytes, &file); err != nil {
+		return file, err
+	}
+
+	switch file.RequestAuthorizer {
+	case "":
+		file.RequestAuthorizer = RequestAuthorizerNone
+	case RequestAuthorizerNone, RequestAuthorizerGitHub:
+	case RequestAuthorizerUpstream:
+		if len(file.UpstreamHosts) == 0 {
+			return file, fmt.Errorf("upstream_hosts must be set, if request_authorizer is %q", RequestAuthorizerUpstream)
+		}
+	case RequestAuthorizerStatic:
+		if file.StaticTokensFile == "" {
+			return file, fmt.Errorf("static_tokens_file must be set, if request_authorizer is %q", RequestAuthorizerStatic)
+		}
+	case RequestAuthorizerOIDC:
+		if file.OIDC == nil {
+			return file, fmt.Errorf("oidc must be set, if request_authorizer is %q", RequestAuthorizerOIDC)
+		}
+	default:
+		return file, fmt.Errorf("unknown request_authorizer %q", file.RequestAuthorizer)
+	}
+
+	switch file.MetricsExporter {
+	case "":
+		file.MetricsExporter = MetricsExporterDatadog
+	case MetricsExporterDatadog, MetricsExporterPrometheus:
+	default:
+		return file, fmt.Errorf("unknown metrics_exporter %q", file.MetricsExporter)
+	}
+
+	switch file.LogFormat {
+	case "":
+		file.LogFormat = LogFormatJSON
+	case LogFormatJSON, LogFormatText:
+	default:
+		return file, fmt.Errorf("unknown log_format %q", file.LogFormat)
+	}
+	switch file.AccessLogFormat {
+	case "":
+		file.AccessLogFormat = AccessLogFormatCombined
+	case AccessLogFormatCombined, AccessLogFormatJSON:
+	default:
+		return file, fmt.Errorf("unknown access_log_format %q", file.AccessLogFormat)
+	}
+	switch {
+	case file.AccessLogSuccessSampleRatio == 0:
+		file.AccessLogSuccessSampleRatio = 1
+	case file.AccessLogSuccessSampleRatio < 0 || file.AccessLogSuccessSampleRatio > 1:
+		return file, fmt.Errorf("access_log_success_sample_ratio must be between 0 and 1")
+	}
+
+	if v := file.ReadinessMaxStalenessSeconds; v != nil && *v < 0 {
+		return file, fmt.Errorf("readiness_max_staleness_seconds must not be negative")
+	}
+	if v := file.ReadinessMinFreeDiskMB; v != nil && *v < 0 {
+		return file, fmt.Errorf("readiness_min_free_disk_mb must not be negative")
+	}
+
+	for subsystem := range file.LogLevels {
+		switch subsystem {
+		case LogServer, LogRepository, LogAuth, LogGitHub:
+		default:
+			return file, fmt.Errorf("unknown log_levels subsystem %q", subsystem)
+		}
+	}
+
+	if file.CredentialPassthrough && file.RequestAuthorizer != RequestAuthorizerGitHub && file.RequestAuthorizer != RequestAuthorizerUpstream {
+		return file, fmt.Errorf("credential_passthrough requires request_authorizer %q or %q", RequestAuthorizerGitHub, RequestAuthorizerUpstream)
+	}
+
+	if file.Tracing != nil {
+		switch file.Tracing.Exporter {
+		case TraceExporterOTLP:
+			if file.Tracing.Endpoint == "" {
+				return file, fmt.Errorf("tracing.endpoint must be set, if tracing.exporter is %q", TraceExporterOTLP)
+			}
+		case TraceExporterStdout:
+		default:
+			return file, fmt.Errorf("unknown tracing.exporter %q", file.Tracing.Exporter)
+		}
+		if file.Tracing.SampleRatio < 0 || file.Tracing.SampleRatio > 1 {
+			return file, fmt.Errorf("tracing.sample_ratio must be between 0 and 1")
+		}
+	}
+
+	if file.TLS != nil {
+		if file.TLS.CertFile == "" || file.TLS.KeyFile == "" {
+			return file, fmt.Errorf("tls.cert_file and tls.key_file must be set, if tls is set")
+		}
+		if file.TLS.ClientCAFile == "" && (file.TLS.RequireClientCert || len(file.TLS.ClientCertificateRules) > 0) {
+			return file, fmt.Errorf("tls.client_ca_file must be set, if client certificates are required or have rules")
+		}
+	}
+	return file, nil
+}
+
+// LoadStaticTokens reads a file holding one token per line. Blank lines and
+// lines starting with '#' are ignored.
+func LoadStaticTokens(path string) ([]string, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tokens := []string{}
+	for line := range strings.SplitSeq(string(bytes), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, line)
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no tokens found in %s", path)
+	}
+	return tokens, nil
 }
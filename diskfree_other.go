@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !windows
+
+package goblet
+
+import "errors"
+
+func diskFreeBytes(path string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,17 @@
+package goblet
+
+import "golang.org/x/sys/windows"
+
+// diskFreeBytes returns the space available to the current user on the volume
+// of path.
+func diskFreeBytes(path string) (uint64, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &free, nil, nil); err != nil {
+		return 0, err
+	}
+	return free, nil
+}
@@ -18,7 +18,6 @@ import (
 	"bytes"
 	"context"
 	"io"
-	"log"
 	"strings"
 	"time"
 
@@ -60,7 +59,7 @@ func handleV2Command(ctx context.Context, reporter gitProtocolErrorReporter, rep
 			return false
 		}
 
-		resp, err := repo.lsRefsUpstream(command)
+		resp, err := repo.lsRefsUpstream(ctx, command)
 		if err != nil {
 			reporter.reportError(ctx, startTime, err)
 			return false
@@ -95,7 +94,13 @@ func handleV2Command(ctx context.Context, reporter gitProtocolErrorReporter, rep
 		reporter.reportError(ctx, startTime, nil)
 		return true
 
+	case "bundle-uri":
+		writeResp(w, repo.bundleURIResponse())
+		reporter.reportError(ctx, startTime, nil)
+		return true
+
 	case "fetch":
+		logger := repo.logger().With("command", "fetch", "ci_source", ci_source, "principal", PrincipalFromContext(ctx))
 		wantHashes, wantRefs, err := parseFetchWants(command)
 		if err != nil {
 			reporter.reportError(ctx, startTime, err)
@@ -106,25 +111,28 @@ func handleV2Command(ctx context.Context, reporter gitProtocolErrorReporter, rep
 			reporter.reportError(ctx, startTime, err)
 			return false
 		} else if !hasAllWants {
-			ctx, err = tag.New(ctx, tag.Update(CommandCacheStateKey, "queried-upsteam"))
+			ctx, err = tag.New(ctx, tag.Update(CommandCacheStateKey, "queried-upstream"))
 			if err != nil {
 				reporter.reportError(ctx, startTime, err)
 				return false
 			}
 
+			var fetchErr error
 			fetchStartTime := time.Now()
+			_, queueSpan := repo.startSpan(ctx, "fetchUpstreamPool queue")
 			repo.fetchUpstreamPool.SubmitAndWait(func() {
-				logElapsed("FetchUpstream queuing", fetchStartTime, time.Minute, repo.localDiskPath)
+				queueSpan.End()
+				repo.logElapsed("FetchUpstream queuing", fetchStartTime, time.Minute)
 
 				// check again when the task is picked up
 				hasAllWants, err := repo.hasAllWants(wantHashes, wantRefs)
 				if err == nil {
 					if !hasAllWants {
-						log.Printf("FetchUpstream required since wants are not satisfied (%s)\n", repo.localDiskPath)
-						StatsdClient.Incr("goblet.operation.count", []string{"dir:" + repo.localDiskPath, "op:ondemand_fetch", "triggered_by:hasallwants"}, 1)
-						repo.fetchUpstream(wantHashes)
+						logger.Info("FetchUpstream required since wants are not satisfied")
+						repo.config.metrics().Count("goblet.operation.count", 1, []string{"dir:" + repo.localDiskPath, "op:ondemand_fetch", "triggered_by:hasallwants"})
+						fetchErr = repo.fetchUpstream(ctx, wantHashes)
 					} else {
-						log.Printf("FetchUpstream skipped since wants are satisfied (%s)\n", repo.localDiskPath)
+						logger.Debug("FetchUpstream skipped since wants are satisfied")
 					}
 				}
 			})
@@ -132,27 +140,35 @@ func handleV2Command(ctx context.Context, reporter gitProtocolErrorReporter, rep
 			select {
 			case <-ctx.Done():
 				reporter.reportError(ctx, startTime, ctx.Err())
-				log.Printf("ServeFetchLocal cancelled since request was closed (%s)\n", repo.localDiskPath)
+				logger.Info("ServeFetchLocal cancelled since the request was closed")
 				return false
 			default:
 				if hasAllWants, checkErr := repo.hasAllWants(wantHashes, wantRefs); checkErr != nil {
-					log.Printf("ServeFetchLocal cancelled since wants throws error after fetch (%s %v)\n", repo.localDiskPath, checkErr)
+					logger.Error("ServeFetchLocal cancelled since wants cannot be checked after fetch", "err", checkErr)
 					reporter.reportError(ctx, startTime, checkErr)
 					return false
 				} else if !hasAllWants {
+					err := status.Error(codes.NotFound, "the wanted objects are not found upstream")
+					if fetchErr != nil {
+						err = status.Errorf(codes.Unavailable, "cannot fetch the wanted objects from upstream: %v", fetchErr)
+					}
 					reporter.reportError(ctx, startTime, err)
-					log.Printf("ServeFetchLocal cancelled since wants are not satisfied after fetch (%s)\n", repo.localDiskPath)
+					logger.Warn("ServeFetchLocal cancelled since wants are not satisfied after fetch")
 					return false
 				}
 			}
-			stats.Record(ctx, UpstreamFetchWaitingTime.M(int64(time.Since(fetchStartTime)/time.Millisecond)))
+			upstreamWait := time.Since(fetchStartTime)
+			stats.Record(ctx, UpstreamFetchWaitingTime.M(int64(upstreamWait/time.Millisecond)))
+			updateRequestState(ctx, func(s *requestState) { s.upstreamWait += upstreamWait })
 		}
 
 		errorChan := make(chan error, 1)
 		serveStartTime := time.Now()
+		_, queueSpan := repo.startSpan(ctx, "serveFetchPool queue")
 		repo.serveFetchPool.Submit(func() {
-			logElapsed("ServeFetchLocal queuing", serveStartTime, time.Minute, repo.localDiskPath)
-			errorChan <- repo.serveFetchLocal(command, w, ci_source)
+			queueSpan.End()
+			repo.logElapsed("ServeFetchLocal queuing", serveStartTime, time.Minute)
+			errorChan <- repo.serveFetchLocal(ctx, command, w, ci_source)
 		})
 
 		err = <-errorChan
@@ -169,7 +185,7 @@ func logV2Request(chunks []*gitprotocolio.ProtocolV2RequestChunk, repo *managedR
 		buffer.Write(c.EncodeToPktLine())
 		buffer.WriteRune(' ')
 	}
-	log.Printf("Received V2 Request")
+	repo.logger().Debug("Received a V2 request", "request", buffer.String())
 }
 
 func generateV2RequestMetricTags(chunks []*gitprotocolio.ProtocolV2RequestChunk, repo *managedRepository) []string {
@@ -21,7 +21,6 @@ import (
 	"fmt"
 	"io"
 
-	"log"
 	"net/http"
 	"time"
 
@@ -33,12 +32,17 @@ import (
 // GenerateOAuthTokenFromApp generates a GitHub OAuth access token from a set of valid GitHub App credentials. The
 // returned token can be used to interact with both GitHub's REST and GraphQL APIs.
 func GenerateOAuthTokenFromApp(appID, installationID string, privateKey *rsa.PrivateKey) (oauth2.Token, error) {
+	return DotCom.GenerateOAuthTokenFromApp(appID, installationID, privateKey)
+}
+
+// GenerateOAuthTokenFromApp generates an OAuth access token of a GitHub App installation on this host.
+func (h *Host) GenerateOAuthTokenFromApp(appID, installationID string, privateKey *rsa.PrivateKey) (oauth2.Token, error) {
 	appJWT, err := generateAppJWT(appID, time.Now(), privateKey)
 	if err != nil {
 		return oauth2.Token{}, err
 	}
 
-	token, err := getInstallationAccessToken(appJWT, installationID)
+	token, err := h.getInstallationAccessToken(appJWT, installationID)
 	if err != nil {
 		return oauth2.Token{}, err
 	}
@@ -46,8 +50,8 @@ func GenerateOAuthTokenFromApp(appID, installationID string, privateKey *rsa.Pri
 	return token, nil
 }
 
-func getInstallationAccessToken(jwt string, installationID string) (oauth2.Token, error) {
-	url := fmt.Sprintf("https://api.github.com/app/installations/%s/access_tokens", installationID)
+func (h *Host) getInstallationAccessToken(jwt string, installationID string) (oauth2.Token, error) {
+	url := h.apiEndpoint("/app/installations/%s/access_tokens", installationID)
 
 	req, err := http.NewRequest(http.MethodPost, url, nil)
 	if err != nil {
@@ -59,26 +63,28 @@ func getInstallationAccessToken(jwt string, installationID string) (oauth2.Token
 
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Printf("GitHub App token request failed (url:%s, err:%v)\n", url, err)
+		logger().Error("GitHub App token request failed", "url", url, "err", err)
 		return oauth2.Token{}, err
 	}
 	defer func() { _ = res.Body.Close() }()
 
 	resBytes, err := io.ReadAll(res.Body)
 	if err != nil {
-		log.Printf("GitHub App token response read failed (url:%s, err:%v)\n", url, err)
+		logger().Error("GitHub App token response read failed", "url", url, "err", err)
 		return oauth2.Token{}, err
 	}
 
-	// Log response headers
-	log.Printf("GitHub App token response (url:%s, status:%d, headers:%v)\n", url, res.StatusCode, res.Header)
+	logger().Debug("GitHub App token response", "url", url, "status", res.StatusCode, "headers", res.Header)
 
 	// Log GitHub rate limit headers
 	logGitHubRateLimitHeaders("TokenGeneration", url, res)
 
 	if res.StatusCode != http.StatusCreated {
-		log.Printf("GitHub App token creation failed with non-OK response (url:%s, status:%d, content-type:%s, error:%s)\n",
-			url, res.StatusCode, res.Header.Get("Content-Type"), string(resBytes))
+		logger().Error("GitHub App token creation failed with a non-OK response",
+			"url", url,
+			"status", res.StatusCode,
+			"content_type", res.Header.Get("Content-Type"),
+			"body", string(resBytes))
 		return oauth2.Token{}, fmt.Errorf("failed to create OAuth token from GitHub App: %s", string(resBytes))
 	}
 
@@ -94,7 +100,7 @@ func getInstallationAccessToken(jwt string, installationID string) (oauth2.Token
 
 	exp, err := time.Parse(time.RFC3339, resData.ExpiresAt)
 	if err != nil {
-		return oauth2.Token{}, nil
+		return oauth2.Token{}, fmt.Errorf("cannot parse the expiry of the GitHub App token: %v", err)
 	}
 
 	return oauth2.Token{
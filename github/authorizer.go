@@ -5,53 +5,44 @@ import (
 	"errors"
 	"fmt"
 	"io"
-
-	"log"
 	"net/http"
-	"net/url"
-	"strings"
-	"time"
 
 	grpccodes "google.golang.org/grpc/codes"
 	grpcstatus "google.golang.org/grpc/status"
 
-	"github.com/DataDog/datadog-go/statsd"
-	"github.com/ReneKroon/ttlcache/v2"
+	"github.com/canva/goblet"
 )
 
 type CacheableAuthorizer struct {
-	cache        *ttlcache.Cache // Set cache to nil to disable caching
-	statsdClient *statsd.Client
+	host    *Host
+	cache   *goblet.AuthDecisionCache // Set cache to nil to disable caching
+	metrics goblet.Metrics
 }
 
 type CacheMetrics struct {
-	Keys    int64 // the number of keys currently in the cache
-	Hits    int64 // the total number of cache hits
-	Misses  int64 // the total number of cache misses
-	Inserts int64 // the total number of keys ever inserted into the cache
-	Removes int64 // the total number of keys ever removed from the cache, either expired or evicted
+	Keys      int64 // the number of keys currently in the cache
+	Hits      int64 // the total number of cache hits
+	Misses    int64 // the total number of cache misses
+	Inserts   int64 // the total number of keys ever inserted into the cache
+	Removes   int64 // the total number of keys ever removed from the cache, either expired or evicted
+	StaleHits int64 // the total number of expired decisions used while GitHub was unavailable
 }
 
-func NewAuthorizer(enableCache bool, statsdClient *statsd.Client) CacheableAuthorizer {
-	if enableCache {
-		cache := ttlcache.NewCache()
-		cache.SetTTL(time.Duration(15 * time.Minute))
-		cache.SkipTTLExtensionOnHit(true) // set this to true so that TTL won't get extended on cache hit
-		cache.SetCacheSizeLimit(1000 * 1000)
-		return CacheableAuthorizer{
-			cache:        cache,
-			statsdClient: statsdClient,
-		}
+const (
+	DefaultCacheTTL  = goblet.DefaultAuthCacheTTL
+	DefaultCacheSize = goblet.DefaultAuthCacheSize
+)
+
+// NewAuthorizer returns an authorizer that validates client tokens against
+// GitHub, caching the decisions in cache unless it is nil. metrics can be nil.
+func NewAuthorizer(host *Host, cache *goblet.AuthDecisionCache, metrics goblet.Metrics) CacheableAuthorizer {
+	if metrics == nil {
+		metrics = goblet.NoopMetrics{}
 	}
 	return CacheableAuthorizer{
-		cache:        nil,
-		statsdClient: statsdClient,
-	}
-}
-
-func (authorizer CacheableAuthorizer) Close() {
-	if authorizer.cache != nil {
-		authorizer.cache.Close()
+		host:    hostOrDotCom(host),
+		cache:   cache,
+		metrics: metrics,
 	}
 }
 
@@ -66,33 +57,33 @@ func (authorizer CacheableAuthorizer) RequestAuthorizer(req *http.Request) error
 	// https://docs.github.com/en/developers/apps/authenticating-with-github-apps#http-based-git-access-by-an-installation
 	if username != "x-access-token" {
 		// Reject any requests with unexpected username values.
-		authorizer.statsdClient.Incr("goblet.authentication.failed", []string{"reason:wrong_username"}, 1)
+		authorizer.metrics.Count("goblet.authentication.failed", 1, []string{"reason:wrong_username"})
 		return grpcstatus.Error(grpccodes.InvalidArgument, "malformed request")
 	}
 
-	pathParts := strings.Split(strings.TrimPrefix(req.URL.Path, "/"), "/")
-	if len(pathParts) < 2 {
+	repoOwner, repoName, ok := authorizer.host.ownerAndRepo(req.URL.Path)
+	if !ok {
 		// All GitHub repository URLs will have, at least, two parts. Thus, reject
 		// any request that does not adhere to the expected format.
-		authorizer.statsdClient.Incr("goblet.authentication.failed", []string{"reason:malformed_url"}, 1)
+		authorizer.metrics.Count("goblet.authentication.failed", 1, []string{"reason:malformed_url"})
 		return grpcstatus.Error(grpccodes.InvalidArgument, "malformed request")
 	}
 
-	repoOwner, repoName := url.PathEscape(pathParts[0]), url.PathEscape(pathParts[1])
-	repoURL := fmt.Sprintf("https://github.com/%s/%s", repoOwner, repoName)
+	repoURL := authorizer.host.repositoryURL(repoOwner, repoName)
 
 	authorized, err := authorizer.isAuthorized(token, repoURL)
 	if !authorized {
 		if err != nil {
-			log.Printf("Authentication error: %v\n", err)
+			goblet.Logger(goblet.LogAuth).Info("Authentication error", "repo", repoURL, "err", err)
 		}
-		authorizer.statsdClient.Incr("goblet.authentication.failed", []string{"reason:access_denied"}, 1)
+		authorizer.metrics.Count("goblet.authentication.failed", 1, []string{"reason:access_denied"})
 		return grpcstatus.Error(grpccodes.PermissionDenied, "access denied")
 	}
 
 	// Ensures that the authorization token isn't leaked further down the chain after
 	// the request has been successfully validated.
 	req.Header.Del("Authorization")
+	goblet.SetPrincipal(req, "github:"+goblet.CredentialFingerprint(token))
 
 	return nil
 }
@@ -100,23 +91,14 @@ func (authorizer CacheableAuthorizer) RequestAuthorizer(req *http.Request) error
 func (authorizer CacheableAuthorizer) isAuthorized(token string, repoURL string) (bool, error) {
 	if authorizer.cache == nil {
 		authorized, _, err := isTokenValid(token, repoURL)
-		authorizer.statsdClient.Incr("goblet.operation.count", []string{"op:token_validation"}, 1)
+		authorizer.metrics.Count("goblet.operation.count", 1, []string{"op:token_validation"})
 		return authorized, err
 	}
 
-	cacheKey := fmt.Sprintf("%s@%s", token, repoURL)
-	if authorized, err := authorizer.cache.Get(cacheKey); err == nil {
-		// return the cached result. We will lose the original error if any
-		return authorized.(bool), nil
-	}
-
-	authorized, shouldCache, err := isTokenValid(token, repoURL)
-	authorizer.statsdClient.Incr("goblet.operation.count", []string{"op:token_validation"}, 1)
-	if shouldCache {
-		authorizer.cache.Set(cacheKey, authorized)
-	}
-
-	return authorized, err
+	return authorizer.cache.Authorize(token, repoURL, func() (bool, bool, error) {
+		authorizer.metrics.Count("goblet.operation.count", 1, []string{"op:token_validation"})
+		return isTokenValid(token, repoURL)
+	})
 }
 
 // This function queries Github to validate if the `token` has access to the `repoURL`.
@@ -127,7 +109,7 @@ func (authorizer CacheableAuthorizer) isAuthorized(token string, repoURL string)
 func isTokenValid(token string, repoURL string) (bool, bool, error) {
 	infoRefsURL := fmt.Sprintf("%s/info/refs?service=git-upload-pack", repoURL)
 
-	log.Printf("Validating token against %s\n", infoRefsURL)
+	goblet.Logger(goblet.LogAuth).Debug("Validating a token", "url", infoRefsURL)
 
 	req, err := http.NewRequest(http.MethodGet, infoRefsURL, nil)
 	if err != nil {
@@ -139,8 +121,9 @@ func isTokenValid(token string, repoURL string) (bool, bool, error) {
 
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Printf("GitHub authorization request failed (url:%s, err:%v)\n", infoRefsURL, err)
-		return false, true, err
+		goblet.Logger(goblet.LogAuth).Error("GitHub authorization request failed", "url", infoRefsURL, "err", err)
+		// GitHub is unreachable, which says nothing about the token.
+		return false, false, err
 	}
 	defer res.Body.Close()
 
@@ -149,19 +132,19 @@ func isTokenValid(token string, repoURL string) (bool, bool, error) {
 
 	resBytes, err := io.ReadAll(res.Body)
 	if err != nil {
-		log.Printf("GitHub authorization response read failed (url:%s, err:%v)\n", infoRefsURL, err)
-		return false, true, err
+		goblet.Logger(goblet.LogAuth).Error("GitHub authorization response read failed", "url", infoRefsURL, "err", err)
+		return false, false, err
 	}
 
-	// Log response headers
-	log.Printf("GitHub authorization response (url:%s, status:%d, headers:%v)\n", infoRefsURL, res.StatusCode, res.Header)
+	goblet.Logger(goblet.LogAuth).Debug("GitHub authorization response", "url", infoRefsURL, "status", res.StatusCode, "headers", res.Header)
 
 	if res.StatusCode != http.StatusOK {
-		log.Printf("Token validation failed (status=%d, url=%s, body_preview=%s)\n",
-			res.StatusCode, infoRefsURL, truncateString(string(resBytes), 200))
+		goblet.Logger(goblet.LogAuth).Info("GitHub authorization failed with a non-OK response",
+			"url", infoRefsURL,
+			"status", res.StatusCode,
+			"content_type", res.Header.Get("Content-Type"),
+			"body_preview", truncateString(string(resBytes), 200))
 		err = errors.New(string(resBytes))
-		log.Printf("GitHub authorization failed with non-OK response (url:%s, status:%d, content-type:%s, error:%s)\n",
-			infoRefsURL, res.StatusCode, res.Header.Get("Content-Type"), string(resBytes))
 
 		// should not cache result if statusCode matches these, so next authorization attempt will retry
 		if res.StatusCode >= 500 && res.StatusCode < 600 && res.StatusCode != 501 {
@@ -177,13 +160,16 @@ func isTokenValid(token string, repoURL string) (bool, bool, error) {
 func (authorizer CacheableAuthorizer) CacheMetrics() CacheMetrics {
 	var metrics CacheMetrics
 	if authorizer.cache != nil {
-		internalMetrics := authorizer.cache.GetMetrics()
-		// the keys in cache.GetMetrics() are a bit misleading, so we will map them to our own keys
-		metrics.Keys = int64(authorizer.cache.Count())
-		metrics.Hits = internalMetrics.Retrievals
-		metrics.Misses = internalMetrics.Misses
-		metrics.Inserts = internalMetrics.Inserted
-		metrics.Removes = internalMetrics.Evicted
+		decisionMetrics := authorizer.cache.Metrics()
+		metrics.Hits = decisionMetrics.Hits
+		metrics.Misses = decisionMetrics.Misses
+		metrics.Inserts = decisionMetrics.Inserts
+		metrics.StaleHits = decisionMetrics.StaleHits
+		// Shared stores may not know their size.
+		if store, ok := authorizer.cache.Store.(*goblet.MemoryAuthCache); ok {
+			metrics.Keys = int64(store.Len())
+			metrics.Removes = store.Evictions()
+		}
 	}
 	return metrics
 }
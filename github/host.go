@@ -0,0 +1,95 @@
+package github
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/canva/goblet"
+)
+
+// Host holds the base URLs of a GitHub instance, either github.com or a
+// GitHub Enterprise Server.
+type Host struct {
+	// WebURL is where the repositories are served, e.g. https://github.com.
+	WebURL *url.URL
+
+	// APIURL is the base of the REST API, e.g. https://api.github.com.
+	APIURL *url.URL
+}
+
+// DotCom is the Host of github.com.
+var DotCom = &Host{
+	WebURL: &url.URL{Scheme: "https", Host: "github.com"},
+	APIURL: &url.URL{Scheme: "https", Host: "api.github.com"},
+}
+
+// NewEnterpriseHost returns the Host of a GitHub Enterprise Server. When
+// apiURL is empty, it defaults to the "/api/v3" path of webURL, which is
+// where GitHub Enterprise Server serves its REST API.
+func NewEnterpriseHost(webURL, apiURL string) (*Host, error) {
+	w, err := url.Parse(strings.TrimSuffix(webURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid github web url: %v", err)
+	}
+	if w.Scheme == "" || w.Host == "" {
+		return nil, fmt.Errorf("invalid github web url %q: scheme and host must be provided", webURL)
+	}
+
+	if apiURL == "" {
+		apiURL = w.String() + "/api/v3"
+	}
+	a, err := url.Parse(strings.TrimSuffix(apiURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid github api url: %v", err)
+	}
+	if a.Scheme == "" || a.Host == "" {
+		return nil, fmt.Errorf("invalid github api url %q: scheme and host must be provided", apiURL)
+	}
+
+	return &Host{WebURL: w, APIURL: a}, nil
+}
+
+// URLCanonicalizer canonicalizes the URLs of repositories on this host. Like
+// GitHub itself, it treats owner and repository names case-insensitively.
+func (h *Host) URLCanonicalizer(u *url.URL) (*url.URL, error) {
+	ret, err := goblet.DefaultURLCanonicalizer(u)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.EqualFold(ret.Host, h.WebURL.Host) {
+		ret.Scheme = h.WebURL.Scheme
+		ret.Path = strings.ToLower(ret.Path)
+	}
+
+	return ret, nil
+}
+
+// apiEndpoint returns the URL of a REST API path, e.g. "/app/installations".
+func (h *Host) apiEndpoint(format string, a ...any) string {
+	return strings.TrimSuffix(h.APIURL.String(), "/") + fmt.Sprintf(format, a...)
+}
+
+// repositoryURL returns the web URL of a repository.
+func (h *Host) repositoryURL(owner, repo string) string {
+	return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(h.WebURL.String(), "/"), url.PathEscape(owner), url.PathEscape(repo))
+}
+
+// ownerAndRepo extracts the owner and repository names from a URL path on
+// this host.
+func (h *Host) ownerAndRepo(urlPath string) (string, string, bool) {
+	urlPath = strings.TrimPrefix(urlPath, strings.TrimSuffix(h.WebURL.Path, "/"))
+	pathParts := strings.Split(strings.Trim(urlPath, "/"), "/")
+	if len(pathParts) < 2 || pathParts[0] == "" || pathParts[1] == "" {
+		return "", "", false
+	}
+	return pathParts[0], pathParts[1], true
+}
+
+func hostOrDotCom(h *Host) *Host {
+	if h == nil {
+		return DotCom
+	}
+	return h
+}
@@ -0,0 +1,86 @@
+package github
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newFakeEnterpriseServer(t *testing.T, handler http.HandlerFunc) (*Host, *rsa.PrivateKey) {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	host, err := NewEnterpriseHost(srv.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, pk
+}
+
+func TestGenerateOAuthTokenFromApp_Enterprise(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	host, pk := newFakeEnterpriseServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v3/app/installations/42/access_tokens" {
+			http.NotFound(w, r)
+			return
+		}
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			http.Error(w, "missing app jwt", http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token": "installation-token", "expires_at": %q}`, expiresAt.Format(time.RFC3339))
+	})
+
+	token, err := host.GenerateOAuthTokenFromApp("1", "42", pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := token.AccessToken, base64.StdEncoding.EncodeToString([]byte("x-access-token:installation-token")); got != want {
+		t.Errorf("got access token %s, want %s", got, want)
+	}
+	if !token.Expiry.Equal(expiresAt) {
+		t.Errorf("got expiry %s, want %s", token.Expiry, expiresAt)
+	}
+}
+
+func TestHostURLCanonicalizer(t *testing.T) {
+	host, err := NewEnterpriseHost("https://GHES.example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := host.APIURL.String(), "https://GHES.example.com/api/v3"; got != want {
+		t.Errorf("got api url %s, want %s", got, want)
+	}
+
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{"http://ghes.example.com/Canva/Goblet.git/info/refs", "https://ghes.example.com/canva/goblet"},
+		{"http://github.com/Canva/Goblet/git-upload-pack", "https://github.com/Canva/Goblet"},
+	} {
+		u, err := url.Parse(tc.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := host.URLCanonicalizer(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != tc.want {
+			t.Errorf("URLCanonicalizer(%s) = %s, want %s", tc.in, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package github
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// How long the discovery of the installation of a repository isn't retried
+// after it failed, so that the requests for repositories the app cannot
+// access don't exhaust the rate limit of the GitHub API.
+const discoveryRetryInterval = 5 * time.Minute
+
+// InstallationRule routes the repositories matching Pattern to a GitHub App
+// installation. Pattern is matched against "<owner>/<repo>" with path.Match,
+// case-insensitively, e.g. "canva/*" or "canva-*/goblet".
+type InstallationRule struct {
+	Pattern        string
+	InstallationID string
+}
+
+// InstallationTokenSource mints tokens for the GitHub App installation that
+// has access to the requested repository. The installation is looked up in
+// the rules first, then, if enabled, discovered through the GitHub App API.
+// The repositories that match no rule use the default installation when
+// discovery is disabled. Otherwise, no token is minted for the repositories
+// whose installation cannot be discovered.
+type InstallationTokenSource struct {
+	Host                  *Host
+	AppID                 string
+	PrivateKey            *rsa.PrivateKey
+	DefaultInstallationID string
+	Rules                 []InstallationRule
+	Discover              bool
+
+	tokenExpiryDelta time.Duration
+
+	mu sync.Mutex
+	// Whether the tokens of new installations are renewed in background.
+	renewing bool
+	// Stops the background renewal of the tokens of every installation.
+	stopRenewals []func()
+	// *TokenSource keyed by installation ID.
+	sources map[string]*TokenSource
+	// Installation ID keyed by lowercased owner, as discovered.
+	discovered map[string]string
+	// Time of the last failed discovery keyed by lowercased
+	// "<owner>/<repo>".
+	failedDiscoveries map[string]time.Time
+}
+
+// Token returns a token of the default installation.
+func (ts *InstallationTokenSource) Token() (*oauth2.Token, error) {
+	if ts.DefaultInstallationID == "" {
+		return nil, fmt.Errorf("github app default installation id is not configured")
+	}
+	return ts.installationTokenSource(ts.DefaultInstallationID).Token()
+}
+
+// TokenForURL returns a token of the installation that serves the repository
+// at u.
+func (ts *InstallationTokenSource) TokenForURL(u *url.URL) (*oauth2.Token, error) {
+	owner, repo, ok := hostOrDotCom(ts.Host).ownerAndRepo(u.Path)
+	if !ok {
+		return ts.Token()
+	}
+
+	installationID, err := ts.installationID(owner, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := ts.installationTokenSource(installationID).Token()
+	if err != nil {
+		// The app may have been uninstalled from the owner since it was
+		// discovered. Discover it again next time.
+		ts.mu.Lock()
+		delete(ts.discovered, strings.ToLower(owner))
+		ts.mu.Unlock()
+	}
+	return t, err
+}
+
+func (ts *InstallationTokenSource) installationID(owner, repo string) (string, error) {
+	name := strings.ToLower(owner + "/" + repo)
+	for _, rule := range ts.Rules {
+		if ok, _ := path.Match(strings.ToLower(rule.Pattern), name); ok {
+			return rule.InstallationID, nil
+		}
+	}
+
+	if ts.Discover {
+		ts.mu.Lock()
+		installationID, ok := ts.discovered[strings.ToLower(owner)]
+		failedAt, failed := ts.failedDiscoveries[name]
+		ts.mu.Unlock()
+		if ok {
+			return installationID, nil
+		}
+		if failed && time.Since(failedAt) < discoveryRetryInterval {
+			return "", fmt.Errorf("no github app installation found for %s/%s: the discovery failed %s ago", owner, repo, time.Since(failedAt).Truncate(time.Second))
+		}
+
+		installationID, err := ts.discoverInstallationID(owner, repo)
+		ts.mu.Lock()
+		if err != nil {
+			// Forget the expired failures, so that the requests for
+			// arbitrary repositories don't grow the map for good.
+			for n, t := range ts.failedDiscoveries {
+				if time.Since(t) >= discoveryRetryInterval {
+					delete(ts.failedDiscoveries, n)
+				}
+			}
+			ts.failedDiscoveries[name] = time.Now()
+		} else {
+			ts.discovered[strings.ToLower(owner)] = installationID
+			delete(ts.failedDiscoveries, name)
+		}
+		ts.mu.Unlock()
+		if err != nil {
+			logger().Warn("GitHub App installation discovery failed", "owner", owner, "repo", repo, "err", err)
+			return "", fmt.Errorf("cannot discover the github app installation of %s/%s: %v", owner, repo, err)
+		}
+		logger().Info("Discovered a GitHub App installation", "owner", owner, "installation", installationID)
+		return installationID, nil
+	}
+
+	if ts.DefaultInstallationID == "" {
+		return "", fmt.Errorf("no github app installation found for %s/%s", owner, repo)
+	}
+	return ts.DefaultInstallationID, nil
+}
+
+func (ts *InstallationTokenSource) discoverInstallationID(owner, repo string) (string, error) {
+	appJWT, err := generateAppJWT(ts.AppID, time.Now(), ts.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+	return hostOrDotCom(ts.Host).getRepositoryInstallationID(appJWT, owner, repo)
+}
+
+func (ts *InstallationTokenSource) installationTokenSource(installationID string) *TokenSource {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	return ts.installationTokenSourceLocked(installationID)
+}
+
+// installationTokenSourceLocked is installationTokenSource with ts.mu held.
+func (ts *InstallationTokenSource) installationTokenSourceLocked(installationID string) *TokenSource {
+	s, ok := ts.sources[installationID]
+	if !ok {
+		s = &TokenSource{
+			Host:             ts.Host,
+			AppID:            ts.AppID,
+			InstallationID:   installationID,
+			PrivateKey:       ts.PrivateKey,
+			tokenExpiryDelta: ts.tokenExpiryDelta,
+		}
+		ts.sources[installationID] = s
+		if ts.renewing {
+			ts.stopRenewals = append(ts.stopRenewals, s.StartBackgroundRenewal())
+		}
+	}
+	return s
+}
+
+// StartBackgroundRenewal renews the token of every installation that has been
+// used so far, and of the ones used later on, in background. See
+// TokenSource.StartBackgroundRenewal.
+func (ts *InstallationTokenSource) StartBackgroundRenewal() func() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.renewing = true
+	for _, s := range ts.sources {
+		ts.stopRenewals = append(ts.stopRenewals, s.StartBackgroundRenewal())
+	}
+	if ts.DefaultInstallationID != "" {
+		// Starts the renewal of the default installation, if not yet.
+		ts.installationTokenSourceLocked(ts.DefaultInstallationID)
+	}
+
+	return func() {
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+
+		ts.renewing = false
+		for _, stop := range ts.stopRenewals {
+			stop()
+		}
+		ts.stopRenewals = nil
+	}
+}
+
+func (h *Host) getRepositoryInstallationID(jwt, owner, repo string) (string, error) {
+	endpoint := h.apiEndpoint("/repos/%s/%s/installation", url.PathEscape(owner), url.PathEscape(repo))
+
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Add("Accept", "application/vnd.github.v3+json")
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", jwt))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	resBytes, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+
+	logGitHubRateLimitHeaders("InstallationDiscovery", endpoint, res)
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to find the GitHub App installation: %d %s", res.StatusCode, truncateString(string(resBytes), 200))
+	}
+
+	resData := struct {
+		ID int64 `json:"id"`
+	}{}
+	if err := json.Unmarshal(resBytes, &resData); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(resData.ID, 10), nil
+}
+
+func NewInstallationTokenSource(host *Host, appID string, privateKey string, defaultInstallationID string, rules []InstallationRule, discover bool, tokenExpiryDelta time.Duration) (*InstallationTokenSource, error) {
+	if appID == "" {
+		return nil, fmt.Errorf("github app id must be provided")
+	}
+	if defaultInstallationID == "" && len(rules) == 0 && !discover {
+		return nil, fmt.Errorf("github app installation id, installation rules or installation discovery must be provided")
+	}
+	for _, rule := range rules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil || rule.InstallationID == "" {
+			return nil, fmt.Errorf("invalid github app installation rule %q => %q", rule.Pattern, rule.InstallationID)
+		}
+	}
+
+	pk, err := parsePrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	logger().Info("OAuth tokens will be discarded before their expiry", "expiry_delta", tokenExpiryDelta)
+
+	return &InstallationTokenSource{
+		Host:                  hostOrDotCom(host),
+		AppID:                 appID,
+		PrivateKey:            pk,
+		DefaultInstallationID: defaultInstallationID,
+		Rules:                 rules,
+		Discover:              discover,
+		tokenExpiryDelta:      tokenExpiryDelta,
+		sources:               map[string]*TokenSource{},
+		discovered:            map[string]string{},
+		failedDiscoveries:     map[string]time.Time{},
+	}, nil
+}
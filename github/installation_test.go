@@ -0,0 +1,167 @@
+package github
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeInstallations serves the installation of the repositories and the
+// tokens of the installations.
+type fakeInstallations struct {
+	mu sync.Mutex
+	// Installation ID keyed by "<owner>/<repo>".
+	repositories map[string]string
+	// Installations whose tokens cannot be created.
+	broken map[string]bool
+	// Number of discoveries keyed by "<owner>/<repo>".
+	discoveries map[string]int
+}
+
+func (f *fakeInstallations) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if installationID, ok := strings.CutPrefix(r.URL.Path, "/api/v3/app/installations/"); ok {
+		installationID = strings.TrimSuffix(installationID, "/access_tokens")
+		if f.broken[installationID] {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token": "token-%s", "expires_at": %q}`, installationID, time.Now().Add(time.Hour).Format(time.RFC3339))
+		return
+	}
+	if name, ok := strings.CutPrefix(r.URL.Path, "/api/v3/repos/"); ok {
+		name = strings.TrimSuffix(name, "/installation")
+		f.discoveries[name]++
+		if installationID, ok := f.repositories[name]; ok {
+			fmt.Fprintf(w, `{"id": %s}`, installationID)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func newFakeInstallationTokenSource(t *testing.T, rules []InstallationRule, discover bool) (*InstallationTokenSource, *fakeInstallations) {
+	f := &fakeInstallations{repositories: map[string]string{}, broken: map[string]bool{}, discoveries: map[string]int{}}
+	host, pk := newFakeEnterpriseServer(t, f.ServeHTTP)
+	ts := &InstallationTokenSource{
+		Host:                  host,
+		AppID:                 "1",
+		PrivateKey:            pk,
+		DefaultInstallationID: "1",
+		Rules:                 rules,
+		Discover:              discover,
+		sources:               map[string]*TokenSource{},
+		discovered:            map[string]string{},
+		failedDiscoveries:     map[string]time.Time{},
+	}
+	return ts, f
+}
+
+// tokenInstallation returns the installation whose token TokenForURL returns
+// for the repository.
+func tokenInstallation(t *testing.T, ts *InstallationTokenSource, repository string) (string, error) {
+	owner, repo, _ := strings.Cut(repository, "/")
+	u, err := url.Parse(ts.Host.repositoryURL(owner, repo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := ts.TokenForURL(u)
+	if err != nil {
+		return "", err
+	}
+	bs, err := base64.StdEncoding.DecodeString(tok.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimPrefix(string(bs), "x-access-token:token-"), nil
+}
+
+func TestInstallationTokenSource_Rules(t *testing.T) {
+	ts, _ := newFakeInstallationTokenSource(t, []InstallationRule{
+		{Pattern: "canva/*", InstallationID: "7"},
+		{Pattern: "*/goblet", InstallationID: "8"},
+	}, false)
+
+	for repository, want := range map[string]string{
+		"Canva/Goblet": "7",
+		"other/goblet": "8",
+		"other/repo":   "1",
+	} {
+		if got, err := tokenInstallation(t, ts, repository); err != nil {
+			t.Errorf("%s: %v", repository, err)
+		} else if got != want {
+			t.Errorf("%s: got the token of installation %s, want %s", repository, got, want)
+		}
+	}
+}
+
+func TestInstallationTokenSource_Discovery(t *testing.T) {
+	ts, f := newFakeInstallationTokenSource(t, nil, true)
+	f.repositories["canva/goblet"] = "9"
+
+	for range 2 {
+		if got, err := tokenInstallation(t, ts, "canva/goblet"); err != nil {
+			t.Fatal(err)
+		} else if got != "9" {
+			t.Errorf("got the token of installation %s, want 9", got)
+		}
+		// The installations the app doesn't have don't fall back to
+		// the default one.
+		if got, err := tokenInstallation(t, ts, "other/repo"); err == nil {
+			t.Errorf("got the token of installation %s, want an error", got)
+		}
+	}
+	if got := f.discoveries["canva/goblet"]; got != 1 {
+		t.Errorf("discovered canva/goblet %d times, want 1", got)
+	}
+	if got := f.discoveries["other/repo"]; got != 1 {
+		t.Errorf("discovered other/repo %d times, want 1", got)
+	}
+}
+
+func TestInstallationTokenSource_Rediscovery(t *testing.T) {
+	ts, f := newFakeInstallationTokenSource(t, nil, true)
+	// The app was uninstalled from installation 9 and installed again as
+	// installation 10.
+	f.repositories["canva/goblet"] = "9"
+	f.broken["9"] = true
+
+	if got, err := tokenInstallation(t, ts, "canva/goblet"); err == nil {
+		t.Fatalf("got the token of installation %s, want an error", got)
+	}
+	f.mu.Lock()
+	f.repositories["canva/goblet"] = "10"
+	f.mu.Unlock()
+	if got, err := tokenInstallation(t, ts, "canva/goblet"); err != nil {
+		t.Fatal(err)
+	} else if got != "10" {
+		t.Errorf("got the token of installation %s, want 10", got)
+	}
+	if got := f.discoveries["canva/goblet"]; got != 2 {
+		t.Errorf("discovered canva/goblet %d times, want 2", got)
+	}
+}
+
+func TestInstallationTokenSource_FailedDiscoveriesExpire(t *testing.T) {
+	ts, _ := newFakeInstallationTokenSource(t, nil, true)
+	ts.failedDiscoveries["other/expired"] = time.Now().Add(-discoveryRetryInterval)
+
+	if got, err := tokenInstallation(t, ts, "other/repo"); err == nil {
+		t.Fatalf("got the token of installation %s, want an error", got)
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if _, ok := ts.failedDiscoveries["other/expired"]; ok {
+		t.Error("the expired failed discovery was kept")
+	}
+	if _, ok := ts.failedDiscoveries["other/repo"]; !ok {
+		t.Error("the failed discovery was not recorded")
+	}
+}
@@ -1,10 +1,17 @@
 package github
 
 import (
-	"log"
+	"log/slog"
 	"net/http"
+
+	"github.com/canva/goblet"
 )
 
+// logger returns the logger of the GitHub App tokens and API calls.
+func logger() *slog.Logger {
+	return goblet.Logger(goblet.LogGitHub)
+}
+
 // logGitHubRateLimitHeaders logs GitHub rate limit information from response headers
 func logGitHubRateLimitHeaders(operation, url string, res *http.Response) {
 	limit := res.Header.Get("X-RateLimit-Limit")
@@ -14,12 +21,18 @@ func logGitHubRateLimitHeaders(operation, url string, res *http.Response) {
 	resource := res.Header.Get("X-RateLimit-Resource")
 
 	if limit != "" || remaining != "" {
-		log.Printf("[GitHub Rate Limit] operation=%s, url=%s, status=%d, limit=%s, remaining=%s, used=%s, reset=%s, resource=%s\n",
-			operation, url, res.StatusCode, limit, remaining, used, reset, resource)
+		logger().Info("GitHub rate limit",
+			"operation", operation,
+			"url", url,
+			"status", res.StatusCode,
+			"limit", limit,
+			"remaining", remaining,
+			"used", used,
+			"reset", reset,
+			"resource", resource)
 	} else {
 		// Some endpoints might not return rate limit headers
-		log.Printf("[GitHub Response] operation=%s, url=%s, status=%d (no rate limit headers)\n",
-			operation, url, res.StatusCode)
+		logger().Debug("GitHub response without rate limit headers", "operation", operation, "url", url, "status", res.StatusCode)
 	}
 }
 
@@ -15,57 +15,210 @@
 package github
 
 import (
+	"context"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
-	"log"
 	"sync"
 	"time"
 
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
 	"golang.org/x/oauth2"
 )
 
+const (
+	// Number of attempts of a token refresh made by a Token call.
+	tokenRefreshAttempts = 3
+
+	// Initial and maximum delay between two failed token refreshes.
+	tokenRefreshBackoff    = 500 * time.Millisecond
+	tokenRefreshMaxBackoff = time.Minute
+
+	// How long before the token gets discarded the background renewal
+	// replaces it.
+	tokenRenewalLead = 5 * time.Minute
+)
+
+var (
+	// TokenRefreshStatusKey indicates whether a token refresh succeeded
+	// ("success", "failure").
+	TokenRefreshStatusKey = tag.MustNewKey("github.com/google/goblet/token-refresh-status")
+
+	// TokenInstallationKey indicates the GitHub App installation of a token.
+	TokenInstallationKey = tag.MustNewKey("github.com/google/goblet/token-installation")
+
+	// TokenRefreshCount is a count of GitHub App token refreshes.
+	TokenRefreshCount = stats.Int64("github.com/google/goblet/token-refresh-count", "number of GitHub App token refreshes", stats.UnitDimensionless)
+)
+
 type TokenSource struct {
+	// Host is the GitHub instance the app is installed on. Defaults to
+	// github.com.
+	Host           *Host
 	AppID          string
 	InstallationID string
 	PrivateKey     *rsa.PrivateKey
 
 	tokenExpiryDelta time.Duration
 
-	token *oauth2.Token
+	// sleep waits between two attempts of a refresh, time.Sleep if nil.
+	sleep func(time.Duration)
+
 	mu    sync.Mutex
+	token *oauth2.Token
+	// The refresh in flight, if any.
+	refreshing *tokenRefresh
+}
+
+// tokenRefresh is a refresh of the token, that the callers of Token wait for
+// when there is no valid token to return meanwhile.
+type tokenRefresh struct {
+	done chan struct{}
+	err  error
 }
 
 func (ts *TokenSource) Token() (*oauth2.Token, error) {
 	ts.mu.Lock()
-	defer ts.mu.Unlock()
+	token, refreshing := ts.token, ts.refreshing != nil
+	ts.mu.Unlock()
 
-	if ts.token.Valid() {
+	if token.Valid() {
 		currentTime := time.Now()
-		if !ts.token.Expiry.IsZero() && ts.token.Expiry.Round(0).Add(-ts.tokenExpiryDelta).Before(currentTime) {
-			log.Printf("Current OAuth token will expired in %s. Will regenerate.\n", ts.token.Expiry.Sub(currentTime))
+		if !token.Expiry.IsZero() && token.Expiry.Round(0).Add(-ts.tokenExpiryDelta).Before(currentTime) {
+			if refreshing {
+				// GitHub still accepts the token. Don't wait for
+				// the refresh in flight.
+				return token, nil
+			}
+			logger().Info("Regenerating the OAuth token since it is about to expire", "installation", ts.InstallationID, "expires_in", token.Expiry.Sub(currentTime))
 		} else {
-			return ts.token, nil
+			return token, nil
 		}
 	} else {
-		log.Printf("Current OAuth token is not valid. Will regenerate.\n")
+		logger().Info("Regenerating the OAuth token since it is not valid", "installation", ts.InstallationID)
 	}
 
-	ts.token = nil
+	err := ts.refresh(tokenRefreshAttempts)
+	ts.mu.Lock()
+	token = ts.token
+	ts.mu.Unlock()
+	if err != nil {
+		if token.Valid() {
+			// The token is about to be discarded but GitHub still
+			// accepts it. Keep using it until a refresh succeeds.
+			logger().Warn("Using the current OAuth token until it expires", "installation", ts.InstallationID, "expiry", token.Expiry)
+			return token, nil
+		}
+		return nil, fmt.Errorf("no valid OAuth token for installation %s: %v", ts.InstallationID, err)
+	}
 
-	newTok, err := GenerateOAuthTokenFromApp(ts.AppID, ts.InstallationID, ts.PrivateKey)
-	if err == nil {
-		ts.token = &newTok
-		log.Printf("New OAuth token generated. Will expired at %s\n", ts.token.Expiry)
-	} else {
-		log.Printf("New OAuth token generation failed. %v\n", err)
+	return token, nil
+}
+
+// StartBackgroundRenewal keeps renewing the token shortly before Token would
+// consider it stale, so that callers rarely wait for GitHub. Failed renewals
+// are retried with an exponential backoff. A function is returned to stop the
+// renewal.
+func (ts *TokenSource) StartBackgroundRenewal() func() {
+	stop := make(chan struct{})
+	go func() {
+		backoff := tokenRefreshBackoff
+		for {
+			delay := ts.untilRenewal()
+			if backoff > tokenRefreshBackoff {
+				delay = backoff
+			}
+
+			select {
+			case <-time.After(delay):
+			case <-stop:
+				return
+			}
+
+			if err := ts.refresh(1); err != nil {
+				backoff = min(backoff*2, tokenRefreshMaxBackoff)
+			} else {
+				backoff = tokenRefreshBackoff
+			}
+		}
+	}()
+
+	return func() { close(stop) }
+}
+
+func (ts *TokenSource) untilRenewal() time.Duration {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if !ts.token.Valid() || ts.token.Expiry.IsZero() {
+		return 0
 	}
+	return max(time.Until(ts.token.Expiry.Round(0).Add(-ts.tokenExpiryDelta-tokenRenewalLead)), 0)
+}
 
-	return ts.token, nil
+// refresh replaces the token with a newly generated one. The current token is
+// kept if all the attempts fail. The calls made while a refresh is in flight
+// wait for its result instead of refreshing again. ts.mu must not be held: it
+// is only taken to swap the token, so that the callers that have a valid token
+// are never blocked by GitHub or by the backoff.
+func (ts *TokenSource) refresh(attempts int) error {
+	ts.mu.Lock()
+	if r := ts.refreshing; r != nil {
+		ts.mu.Unlock()
+		<-r.done
+		return r.err
+	}
+	r := &tokenRefresh{done: make(chan struct{})}
+	ts.refreshing = r
+	ts.mu.Unlock()
+
+	defer func() {
+		ts.mu.Lock()
+		ts.refreshing = nil
+		ts.mu.Unlock()
+		close(r.done)
+	}()
+
+	sleep := ts.sleep
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+	backoff := tokenRefreshBackoff
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			sleep(backoff)
+			backoff = min(backoff*2, tokenRefreshMaxBackoff)
+		}
+
+		var newTok oauth2.Token
+		newTok, r.err = hostOrDotCom(ts.Host).GenerateOAuthTokenFromApp(ts.AppID, ts.InstallationID, ts.PrivateKey)
+		if r.err == nil {
+			ts.mu.Lock()
+			ts.token = &newTok
+			ts.mu.Unlock()
+			logger().Info("Generated a new OAuth token", "installation", ts.InstallationID, "expiry", newTok.Expiry)
+			ts.recordRefresh("success")
+			return nil
+		}
+		logger().Error("OAuth token generation failed", "installation", ts.InstallationID, "attempt", attempt, "attempts", attempts, "err", r.err)
+		ts.recordRefresh("failure")
+	}
+	return r.err
 }
 
-func NewTokenSource(appID string, installationID string, privateKey string, tokenExpiryDelta time.Duration) (*TokenSource, error) {
+func (ts *TokenSource) recordRefresh(status string) {
+	stats.RecordWithTags(context.Background(),
+		[]tag.Mutator{
+			tag.Insert(TokenRefreshStatusKey, status),
+			tag.Insert(TokenInstallationKey, ts.InstallationID),
+		},
+		TokenRefreshCount.M(1),
+	)
+}
+
+func NewTokenSource(host *Host, appID string, installationID string, privateKey string, tokenExpiryDelta time.Duration) (*TokenSource, error) {
 	if appID == "" {
 		return nil, fmt.Errorf("github app id must be provided")
 	}
@@ -73,22 +226,30 @@ func NewTokenSource(appID string, installationID string, privateKey string, toke
 		return nil, fmt.Errorf("github app installation id must be provided")
 	}
 
-	if privateKey == "" {
-		return nil, fmt.Errorf("github app private key must be provided")
-	}
-
-	block, _ := pem.Decode([]byte(privateKey))
-	pk, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	pk, err := parsePrivateKey(privateKey)
 	if err != nil {
 		return nil, err
 	}
 
-	log.Printf("OAuth token will be discarded %s before its expiry\n", tokenExpiryDelta)
+	logger().Info("OAuth tokens will be discarded before their expiry", "expiry_delta", tokenExpiryDelta)
 
 	return &TokenSource{
+		Host:             hostOrDotCom(host),
 		AppID:            appID,
 		InstallationID:   installationID,
 		PrivateKey:       pk,
 		tokenExpiryDelta: tokenExpiryDelta,
 	}, nil
 }
+
+func parsePrivateKey(privateKey string) (*rsa.PrivateKey, error) {
+	if privateKey == "" {
+		return nil, fmt.Errorf("github app private key must be provided")
+	}
+
+	block, _ := pem.Decode([]byte(privateKey))
+	if block == nil {
+		return nil, fmt.Errorf("github app private key is not PEM encoded")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
@@ -0,0 +1,73 @@
+package github
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestTokenSource_RefreshFailure(t *testing.T) {
+	host, pk := newFakeEnterpriseServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+	var delays []time.Duration
+	ts := &TokenSource{Host: host, AppID: "1", InstallationID: "42", PrivateKey: pk, tokenExpiryDelta: 10 * time.Minute,
+		sleep: func(d time.Duration) { delays = append(delays, d) }}
+
+	if tok, err := ts.Token(); err == nil {
+		t.Fatalf("got token %v, want an error", tok)
+	}
+	if want := []time.Duration{tokenRefreshBackoff, 2 * tokenRefreshBackoff}; !slices.Equal(delays, want) {
+		t.Errorf("got delays %v between the attempts, want %v", delays, want)
+	}
+
+	// A token that is within the expiry delta but still accepted by GitHub
+	// is kept when the refresh fails.
+	old := &oauth2.Token{AccessToken: "old", Expiry: time.Now().Add(5 * time.Minute)}
+	ts.token = old
+	tok, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok != old {
+		t.Errorf("got token %v, want the current one", tok)
+	}
+}
+
+func TestTokenSource_TokenDuringRefresh(t *testing.T) {
+	requested := make(chan struct{})
+	release := make(chan struct{})
+	host, pk := newFakeEnterpriseServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requested <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token": "new", "expires_at": %q}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+	})
+	ts := &TokenSource{Host: host, AppID: "1", InstallationID: "42", PrivateKey: pk, tokenExpiryDelta: 10 * time.Minute}
+	old := &oauth2.Token{AccessToken: "old", Expiry: time.Now().Add(5 * time.Minute)}
+	ts.token = old
+
+	refreshed := make(chan *oauth2.Token)
+	go func() {
+		tok, _ := ts.Token()
+		refreshed <- tok
+	}()
+	<-requested
+
+	// The token still accepted by GitHub is returned without waiting for
+	// the refresh in flight.
+	if tok, err := ts.Token(); err != nil {
+		t.Fatal(err)
+	} else if tok != old {
+		t.Errorf("got token %v, want the current one", tok)
+	}
+
+	close(release)
+	if tok := <-refreshed; tok == old {
+		t.Error("got the current token, want a new one")
+	}
+}
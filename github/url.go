@@ -16,20 +16,10 @@ package github
 
 import (
 	"net/url"
-	"strings"
-
-	"github.com/canva/goblet"
 )
 
+// URLCanonicalizer canonicalizes the URLs of github.com repositories. See
+// Host.URLCanonicalizer for GitHub Enterprise Server.
 func URLCanonicalizer(u *url.URL) (*url.URL, error) {
-	ret, err := goblet.DefaultURLCanonicalizer(u)
-	if err != nil {
-		return nil, err
-	}
-
-	if strings.ToLower(ret.Host) == "github.com" {
-		ret.Path = strings.ToLower(ret.Path)
-	}
-
-	return ret, nil
+	return DotCom.URLCanonicalizer(u)
 }
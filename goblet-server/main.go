@@ -16,28 +16,48 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
-	"net/http/httputil"
 	_ "net/http/pprof"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
+	ocprometheus "contrib.go.opencensus.io/exporter/prometheus"
+	"github.com/DataDog/datadog-go/statsd"
 	datadog "github.com/DataDog/opencensus-go-exporter-datadog"
 	"github.com/canva/goblet"
 	"github.com/canva/goblet/github"
+	"github.com/canva/goblet/oidc"
+	"github.com/canva/goblet/packobjects"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/tag"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"golang.org/x/oauth2"
 )
 
 var (
 	config      = flag.String("config", "", "Path to Goblet's configuration file")
 	checkConfig = flag.Bool("check", false, "Only checking if the config is valid, then exit")
 
+	exportSnapshot = flag.String("export", "", "Export repositories to a snapshot archive at this path ('-' for stdout), then exit")
+	exportRepos    = flag.String("export-repos", "", "Comma-separated repositories to export (defaults to all the configured repositories)")
+	importSnapshot = flag.String("import", "", "Import the repositories of a snapshot archive at this path ('-' for stdin) into the cache root, then exit")
+
 	latencyDistributionAggregation = view.Distribution(
 		100,
 		200,
@@ -96,6 +116,13 @@ var (
 			Measure:     goblet.UpstreamFetchWaitingTime,
 			Aggregation: latencyDistributionAggregation,
 		},
+		{
+			Name:        "github.com/google/goblet/token-refresh-count",
+			Description: "GitHub App token refresh count",
+			TagKeys:     []tag.Key{github.TokenRefreshStatusKey, github.TokenInstallationKey},
+			Measure:     github.TokenRefreshCount,
+			Aggregation: view.Count(),
+		},
 	}
 )
 
@@ -123,12 +150,66 @@ func FetchRepositories(config *goblet.ServerConfig, repositories []string, mustF
 	return errors
 }
 
-func main() {
-	flag.Parse()
+func ExportSnapshot(config *goblet.ServerConfig, path string, repositories []string) error {
+	urls := make([]*url.URL, 0, len(repositories))
+	for _, repository := range repositories {
+		u, err := url.Parse(strings.TrimSpace(repository))
+		if err != nil {
+			return err
+		}
+		urls = append(urls, u)
+	}
+
+	if path == "-" {
+		return goblet.ExportSnapshot(config, os.Stdout, urls)
+	}
+
+	// Write to a temporary file first so that a failed export never leaves
+	// a truncated archive behind.
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	err = goblet.ExportSnapshot(config, f, urls)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("Exported the snapshot", "repositories", len(urls), "path", path)
+	return os.Rename(f.Name(), path)
+}
 
-	if containerID, err := os.Hostname(); err == nil {
-		log.SetPrefix(fmt.Sprintf("[%s] ", containerID))
+func ImportSnapshot(config *goblet.ServerConfig, path string) error {
+	r := io.Reader(os.Stdin)
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	repos, err := goblet.ImportSnapshot(config, r)
+	if err != nil {
+		return err
 	}
+	slog.Info("Imported the snapshot", "repositories", len(repos), "path", path)
+	return nil
+}
+
+func main() {
+	// git upload-pack runs the binary as its pack-objects hook, if
+	// pack_objects_hook is "builtin".
+	if len(os.Args) > 1 && os.Args[1] == packobjects.HookCommand {
+		os.Exit(packobjects.RunHook(os.Args[2:]))
+	}
+
+	flag.Parse()
 
 	if *config == "" {
 		log.Fatal("The '-config' argument is mandatory")
@@ -144,63 +225,255 @@ func main() {
 		return
 	}
 
+	slog.SetDefault(newLogger(configFile))
+
+	gitVersion, err := goblet.CheckGitVersion(configFile.GitBinary)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.Info("Using git", "version", gitVersion)
+
 	if err := view.Register(views...); err != nil {
 		log.Fatal(err)
 	}
 
-	var er = func(r *http.Request, err error) {
-		log.Printf("Error while processing a request: %v", err)
+	var metrics goblet.Metrics
+	var metricsHandler http.Handler
+	if configFile.EnableMetrics {
+		switch configFile.MetricsExporter {
+		case goblet.MetricsExporterDatadog:
+			slog.Info("Initializing the Datadog exporter")
+			dd, err := datadog.NewExporter(datadog.Options{})
+			if err != nil {
+				log.Fatalf("Failed to create the Datadog exporter: %v", err)
+			}
+			// It is imperative to invoke flush before your main function exits
+			defer dd.Stop()
+
+			view.RegisterExporter(dd)
+		case goblet.MetricsExporterPrometheus:
+			slog.Info("Initializing the Prometheus exporter")
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+			pe, err := ocprometheus.NewExporter(ocprometheus.Options{Registry: registry})
+			if err != nil {
+				log.Fatalf("Failed to create the Prometheus exporter: %v", err)
+			}
+
+			view.RegisterExporter(pe)
+			metrics = goblet.NewPrometheusMetrics(registry)
+			metricsHandler = pe
+		}
+	}
+	if metrics == nil {
+		// The metrics recorded outside of the views are sent to the local
+		// statsd agent unless they're served by the Prometheus exporter.
+		statsdClient, err := statsd.New(cmp.Or(configFile.StatsdAddress, "127.0.0.1:8125"))
+		if err != nil {
+			log.Fatalf("Failed to create the statsd client: %v", err)
+		}
+		defer statsdClient.Close()
+		metrics = goblet.NewStatsdMetrics(statsdClient)
 	}
 
-	var rl = func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration) {
-		_, err := httputil.DumpRequest(r, false)
+	var tracerProvider *sdktrace.TracerProvider
+	if configFile.Tracing != nil {
+		tracerProvider, err = newTracerProvider(configFile.Tracing)
 		if err != nil {
-			return
+			log.Fatalf("Failed to create the trace exporter: %v", err)
 		}
-		// log.Printf("%q %d reqsize: %d, respsize %d, latency: %v", dump, status, requestSize, responseSize, latency)
+		defer tracerProvider.Shutdown(context.Background())
+		slog.Info("Exporting traces", "exporter", configFile.Tracing.Exporter, "endpoint", configFile.Tracing.Endpoint)
+	}
+
+	var er = func(r *http.Request, err error) {
+		goblet.Logger(goblet.LogServer).Error("Error while processing a request", "method", r.Method, "path", r.URL.Path, "err", err)
 	}
 
 	var lrol = func(action string, u *url.URL) goblet.RunningOperation {
-		log.Printf("Starting %s for %s", action, u.String())
-		return &logBasedOperation{action, u}
+		// u is the canonical URL, which locates the repository in the cache.
+		logger := goblet.Logger(goblet.LogRepository).With("operation", action, "repo", u.String(), "dir", filepath.Join(configFile.CacheRoot, u.Host, u.Path))
+		logger.Info("Starting an operation")
+		return &logBasedOperation{logger}
 	}
 
-	ts, err := github.NewTokenSource(
-		os.Getenv("GH_APP_ID"),
-		os.Getenv("GH_APP_INSTALLATION_ID"),
-		os.Getenv("GH_APP_PRIVATE_KEY"),
-		time.Duration(configFile.TokenExpiryDeltaSeconds)*time.Second,
-	)
+	githubHost := github.DotCom
+	if configFile.GitHubURL != "" {
+		githubHost, err = github.NewEnterpriseHost(configFile.GitHubURL, configFile.GitHubAPIURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		slog.Info("Using GitHub Enterprise Server", "web", githubHost.WebURL, "api", githubHost.APIURL)
+	}
+
+	if *exportSnapshot != "" || *importSnapshot != "" {
+		// Snapshots only touch the local cache. No upstream credentials
+		// are needed.
+		config := &goblet.ServerConfig{
+			LocalDiskCacheRoot:         configFile.CacheRoot,
+			URLCanonicalizer:           githubHost.URLCanonicalizer,
+			LongRunningOperationLogger: lrol,
+			GitBinary:                  configFile.GitBinary,
+		}
+		if *exportSnapshot != "" {
+			repositories := configFile.Repositories
+			if *exportRepos != "" {
+				repositories = strings.Split(*exportRepos, ",")
+			}
+			if err := ExportSnapshot(config, *exportSnapshot, repositories); err != nil {
+				log.Fatalf("Failed to export the snapshot: %v", err)
+			}
+		}
+		if *importSnapshot != "" {
+			if err := ImportSnapshot(config, *importSnapshot); err != nil {
+				log.Fatalf("Failed to import the snapshot: %v", err)
+			}
+		}
+		return
+	}
+
+	var ts oauth2.TokenSource
+	if len(configFile.GitHubInstallations) > 0 || configFile.DiscoverGitHubInstallations {
+		rules := make([]github.InstallationRule, 0, len(configFile.GitHubInstallations))
+		for _, rule := range configFile.GitHubInstallations {
+			rules = append(rules, github.InstallationRule{Pattern: rule.Pattern, InstallationID: rule.InstallationID})
+		}
+		ts, err = github.NewInstallationTokenSource(
+			githubHost,
+			os.Getenv("GH_APP_ID"),
+			os.Getenv("GH_APP_PRIVATE_KEY"),
+			os.Getenv("GH_APP_INSTALLATION_ID"),
+			rules,
+			configFile.DiscoverGitHubInstallations,
+			time.Duration(configFile.TokenExpiryDeltaSeconds)*time.Second,
+		)
+		slog.Info("Routing upstream tokens to GitHub App installations", "rules", len(rules), "discovery", configFile.DiscoverGitHubInstallations)
+	} else {
+		ts, err = github.NewTokenSource(
+			githubHost,
+			os.Getenv("GH_APP_ID"),
+			os.Getenv("GH_APP_INSTALLATION_ID"),
+			os.Getenv("GH_APP_PRIVATE_KEY"),
+			time.Duration(configFile.TokenExpiryDeltaSeconds)*time.Second,
+		)
+	}
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	authorizer := github.NewAuthorizer(true, goblet.StatsdClient)
-	defer authorizer.Close()
+	// Renew the upstream tokens ahead of their expiry, so that requests
+	// rarely wait for GitHub and transient failures get retried.
+	if r, ok := ts.(interface{ StartBackgroundRenewal() func() }); ok {
+		defer r.StartBackgroundRenewal()()
+	}
+
+	var requestAuthorizer func(*http.Request) error
+	var authCacheMetricsHandler http.HandlerFunc
+	var authCache *goblet.AuthDecisionCache
+	switch configFile.RequestAuthorizer {
+	case goblet.RequestAuthorizerGitHub:
+		var closeAuthCache func()
+		authCache, closeAuthCache = newAuthDecisionCache(configFile)
+		defer closeAuthCache()
+		authorizer := github.NewAuthorizer(githubHost, authCache, metrics)
+		requestAuthorizer = authorizer.RequestAuthorizer
+		authCacheMetricsHandler = authorizer.CacheMetricsHandler
+		slog.Info("Request authorization mode: github (clients need a GitHub token with access to the repository)")
+	case goblet.RequestAuthorizerUpstream:
+		var closeAuthCache func()
+		authCache, closeAuthCache = newAuthDecisionCache(configFile)
+		defer closeAuthCache()
+		authorizer := goblet.NewUpstreamAuthorizer(githubHost.URLCanonicalizer, configFile.UpstreamHosts, authCache, metrics)
+		requestAuthorizer = authorizer.RequestAuthorizer
+		slog.Info("Request authorization mode: upstream (clients need a credential accepted by the upstream repository)")
+	case goblet.RequestAuthorizerOIDC:
+		rules := make([]oidc.Rule, 0, len(configFile.OIDC.Rules))
+		for _, rule := range configFile.OIDC.Rules {
+			rules = append(rules, oidc.Rule{Claims: rule.Claims, Repositories: rule.Repositories})
+		}
+		authorizer, err := oidc.NewAuthorizer(oidc.Config{
+			Issuer:           configFile.OIDC.Issuer,
+			Audience:         configFile.OIDC.Audience,
+			JWKSFile:         configFile.OIDC.JWKSFile,
+			JWKSURL:          configFile.OIDC.JWKSURL,
+			Rules:            rules,
+			URLCanonicalizer: githubHost.URLCanonicalizer,
+		})
+		if err != nil {
+			log.Fatalf("Failed to initialize the OIDC authorizer: %v", err)
+		}
+		requestAuthorizer = authorizer.RequestAuthorizer
+		slog.Info("Request authorization mode: oidc (clients need a token of the issuer for the audience)", "issuer", configFile.OIDC.Issuer, "audience", configFile.OIDC.Audience, "rules", len(rules))
+	case goblet.RequestAuthorizerStatic:
+		tokens, err := goblet.LoadStaticTokens(configFile.StaticTokensFile)
+		if err != nil {
+			log.Fatalf("Failed to load the static tokens: %v", err)
+		}
+		requestAuthorizer = goblet.NewStaticTokenRequestAuthorizer(tokens)
+		slog.Info("Request authorization mode: static (clients need one of the tokens of the file)", "tokens", len(tokens), "file", configFile.StaticTokensFile)
+	default:
+		requestAuthorizer = goblet.NoOpRequestAuthorizer
+		slog.Warn("Request authorization mode: none (any client can fetch any cached repository)")
+	}
+	if configFile.TLS != nil && len(configFile.TLS.ClientCertificateRules) > 0 {
+		rules := make([]goblet.ClientCertificateRule, 0, len(configFile.TLS.ClientCertificateRules))
+		for _, rule := range configFile.TLS.ClientCertificateRules {
+			rules = append(rules, goblet.ClientCertificateRule{Subject: rule.Subject, Repositories: rule.Repositories})
+		}
+		requestAuthorizer = goblet.NewClientCertificateRequestAuthorizer(rules, githubHost.URLCanonicalizer, requestAuthorizer)
+		slog.Info("Client certificates matching one of the rules are authorized by these rules", "rules", len(rules))
+	}
+	if configFile.CredentialPassthrough {
+		slog.Info("Credential passthrough enabled (ls-refs and on-demand fetches use the client's token)")
+	}
+
+	var auditLogger func(*goblet.AuditEntry)
+	if configFile.AuditLog != "" {
+		f, err := openLogFile(configFile.AuditLog, configFile.AuditLogMaxSizeMB, configFile.AuditLogMaxBackups)
+		if err != nil {
+			log.Fatalf("Failed to open the audit log: %v", err)
+		}
+		defer f.Close()
+		auditLogger = goblet.NewJSONAuditLogger(f)
+		slog.Info("Writing the audit log", "path", configFile.AuditLog)
+	}
+
+	var rl func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration)
+	if configFile.AccessLog != "" {
+		f, err := openLogFile(configFile.AccessLog, configFile.AccessLogMaxSizeMB, configFile.AccessLogMaxBackups)
+		if err != nil {
+			log.Fatalf("Failed to open the access log: %v", err)
+		}
+		defer f.Close()
+		rl, err = goblet.NewAccessLogger(f, configFile.AccessLogFormat, configFile.AccessLogSuccessSampleRatio)
+		if err != nil {
+			log.Fatal(err)
+		}
+		slog.Info("Writing the access log", "path", configFile.AccessLog, "format", configFile.AccessLogFormat, "success_sample_ratio", configFile.AccessLogSuccessSampleRatio)
+	}
 
 	config := &goblet.ServerConfig{
 		LocalDiskCacheRoot:         configFile.CacheRoot,
-		URLCanonicalizer:           github.URLCanonicalizer,
-		RequestAuthorizer:          goblet.NoOpRequestAuthorizer,
+		URLCanonicalizer:           githubHost.URLCanonicalizer,
+		RequestAuthorizer:          requestAuthorizer,
 		TokenSource:                ts,
+		CredentialPassthrough:      configFile.CredentialPassthrough,
 		ErrorReporter:              er,
 		RequestLogger:              rl,
 		LongRunningOperationLogger: lrol,
+		AuditLogger:                auditLogger,
 		PackObjectsHook:            configFile.PackObjectsHook,
 		PackObjectsCache:           configFile.PackObjectsCache,
+		PackObjectsStaleTimeout:    time.Duration(configFile.PackObjectsCacheStaleTimeoutSeconds) * time.Second,
+		BundleDir:                  configFile.BundleDir,
+		BundleURL:                  configFile.BundleURL,
+		BundleMaxAge:               time.Duration(configFile.BundleMaxAgeSeconds) * time.Second,
+		GitBinary:                  configFile.GitBinary,
+		Metrics:                    metrics,
 	}
-
-	if configFile.EnableMetrics {
-		log.Println("Initializing Datadog exporter...")
-		dd, err := datadog.NewExporter(datadog.Options{})
-		if err != nil {
-			log.Fatalf("Failed to create the Datadog exporter: %v", err)
-		}
-		// It is imperative to invoke flush before your main function exits
-		defer dd.Stop()
-
-		view.RegisterExporter(dd)
+	if tracerProvider != nil {
+		config.TracerProvider = tracerProvider
 	}
 
 	if configFile.PackObjectsHook != "" {
@@ -208,8 +481,21 @@ func main() {
 			log.Fatalf("pack_objects_cache must be set in config, if pack_objects_hook is set.")
 		}
 	}
+	if configFile.PackObjectsHook == goblet.PackObjectsHookBuiltin {
+		executable, err := os.Executable()
+		if err != nil {
+			log.Fatalf("Cannot find the goblet-server binary to run as the pack-objects hook: %v", err)
+		}
+		config.PackObjectsHook = packobjects.HookCommandLine(executable)
+	}
+
+	if configFile.BundleDir != "" {
+		if configFile.BundleURL == "" {
+			log.Fatalf("bundle_url must be set in config, if bundle_dir is set.")
+		}
+	}
 
-	log.Println("Initializing repositories...")
+	slog.Info("Initializing repositories")
 	for _, repository := range configFile.Repositories {
 		u, err := url.Parse(repository)
 		if err != nil {
@@ -222,49 +508,295 @@ func main() {
 		}
 	}
 
+	// Bootstrap empty repositories from sibling replicas, if any. This saves
+	// the full upstream clone at every deploy; the pre-fetch below then only
+	// needs to catch up with what changed since the peer's last fetch.
+	if len(configFile.Peers) > 0 {
+		slog.Info("Warming up repositories from peers")
+		for _, repository := range configFile.Repositories {
+			u, err := url.Parse(repository)
+			if err != nil {
+				log.Fatalf("Failed to initialize repository '%s': %v", repository, err)
+			}
+
+			if err := goblet.WarmStartFromPeers(config, u, configFile.Peers); err != nil {
+				slog.Warn("Falling back to upstream", "repo", repository, "err", err)
+			}
+		}
+	}
+
 	// Pre-fetch repositories before serving any traffic. This prevents initial
 	// requests from being blocked a long time until the repositories cache is
 	// ready.
-	log.Println("Pre-fetching repositories...")
+	slog.Info("Pre-fetching repositories")
 	if errs := FetchRepositories(config, configFile.Repositories, true); len(errs) > 0 {
 		for _, err := range errs {
-			log.Println(err)
+			slog.Error("Pre-fetch failed", "err", err)
 		}
 		os.Exit(1)
 	}
 
 	// Schedule periodic upstream fetches every 15 minutes.
-	log.Println("Starting background fetches...")
+	slog.Info("Starting background fetches")
 	cancel := goblet.RunEvery(15*time.Minute, func(t time.Time) {
 		for _, err := range FetchRepositories(config, configFile.Repositories, false) {
-			log.Println(err)
+			slog.Error("Background fetch failed", "err", err)
 		}
 	})
 	defer cancel()
 
-	log.Println("Registering HTTP routes...")
+	if configFile.PackObjectsCache != "" {
+		maxBytes, maxAge := packObjectsCacheLimits(configFile)
+		slog.Info("Starting the pack-objects cache janitor", "max_bytes", maxBytes, "max_age", maxAge)
+		cancelJanitor := goblet.RunEvery(time.Minute, func(t time.Time) {
+			cleanPackObjectsCache(configFile, metrics)
+		})
+		defer cancelJanitor()
+	}
+
+	slog.Info("Registering HTTP routes")
 	http.Handle("/", goblet.HTTPHandler(config))
 
+	// /healthz is the liveness probe, and /readyz the readiness one.
 	http.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("Content-Type", "text/plain")
 		io.WriteString(w, "ok\n")
 	})
+	readiness := &goblet.ReadinessConfig{
+		MaxStaleness:     time.Duration(valueOr(configFile.ReadinessMaxStalenessSeconds, 3600)) * time.Second,
+		MinFreeDiskBytes: uint64(valueOr(configFile.ReadinessMinFreeDiskMB, 1024)) << 20,
+	}
+	for _, repository := range configFile.Repositories {
+		if u, err := url.Parse(repository); err == nil {
+			readiness.Repositories = append(readiness.Repositories, u)
+		}
+	}
+	http.Handle("/readyz", goblet.ReadinessHandler(config, readiness))
+
+	if metricsHandler != nil {
+		http.Handle("/metrics", metricsHandler)
+	}
+
+	if authCacheMetricsHandler != nil {
+		http.HandleFunc("/authcache", authCacheMetricsHandler)
+	}
+
+	http.Handle(goblet.BundlePathPrefix, goblet.BundleHandler(config))
+
+	// The admin listener serves the endpoints that must not be reachable by
+	// the clients.
+	if configFile.AdminAddress != "" {
+		adminMux := http.NewServeMux()
+		adminMux.Handle(goblet.PeerBundlePath, goblet.PeerBundleHandler(config))
+		adminMux.Handle("/status", goblet.StatusHandler(config, authCache))
+		adminMux.Handle("/operations", goblet.OperationsHandler())
+		adminMux.Handle("/operations/events", goblet.OperationEventsHandler())
+		go func() {
+			slog.Info("Starting the admin HTTP server", "address", configFile.AdminAddress)
+			log.Fatal(http.ListenAndServe(configFile.AdminAddress, adminMux))
+		}()
+	}
 
-	http.HandleFunc("/authcache", authorizer.CacheMetricsHandler)
+	if configFile.TLS != nil {
+		reloader, err := goblet.NewCertificateReloader(configFile.TLS.CertFile, configFile.TLS.KeyFile)
+		if err != nil {
+			log.Fatalf("Failed to load the TLS certificate: %v", err)
+		}
+		tlsConfig, err := goblet.NewServerTLSConfig(reloader, configFile.TLS.ClientCAFile, configFile.TLS.RequireClientCert)
+		if err != nil {
+			log.Fatalf("Failed to load the client CA certificates: %v", err)
+		}
+		server := &http.Server{
+			Addr:      fmt.Sprintf(":%d", configFile.Port),
+			TLSConfig: tlsConfig,
+		}
+		slog.Info("Starting HTTPS server", "port", configFile.Port, "client_ca", configFile.TLS.ClientCAFile, "require_client_cert", configFile.TLS.RequireClientCert)
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
 
-	log.Printf("Starting HTTP server on port %d...\n", configFile.Port)
+	slog.Info("Starting HTTP server", "port", configFile.Port)
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", configFile.Port), nil))
 }
 
+// newTracerProvider returns a tracer provider exporting the spans as
+// configured. The traces of the clients keep their sampling decision.
+func newTracerProvider(c *goblet.TracingConfig) (*sdktrace.TracerProvider, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch c.Exporter {
+	case goblet.TraceExporterOTLP:
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(c.Endpoint)}
+		if c.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	case goblet.TraceExporterStdout:
+		exporter, err = stdouttrace.New()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ratio := c.SampleRatio
+	if ratio == 0 {
+		ratio = 1
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceNameKey.String("goblet"))),
+	), nil
+}
+
+// newAuthDecisionCache returns the cache of the decisions of the authorizers
+// validating credentials upstream, and a function to release it.
+func newAuthDecisionCache(configFile goblet.ConfigFile) (*goblet.AuthDecisionCache, func()) {
+	var hashKey []byte
+	if configFile.AuthCacheHashKeyFile != "" {
+		bs, err := os.ReadFile(configFile.AuthCacheHashKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to read the auth cache hash key: %v", err)
+		}
+		hashKey = []byte(strings.TrimSpace(string(bs)))
+		if len(hashKey) == 0 {
+			log.Fatalf("The auth cache hash key file %s is empty", configFile.AuthCacheHashKeyFile)
+		}
+	}
+
+	store := goblet.NewMemoryAuthCache(configFile.AuthCacheSize)
+	cache := goblet.NewAuthDecisionCache(
+		store,
+		hashKey,
+		time.Duration(configFile.AuthCacheTTLSeconds)*time.Second,
+		time.Duration(configFile.AuthCacheNegativeTTLSeconds)*time.Second,
+		time.Duration(configFile.AuthCacheStaleIfErrorSeconds)*time.Second,
+	)
+	slog.Info("Caching authorization decisions",
+		"positive_ttl", cache.PositiveTTL,
+		"negative_ttl", cache.NegativeTTL,
+		"stale_if_error", cache.StaleIfError,
+		"size", cmp.Or(configFile.AuthCacheSize, goblet.DefaultAuthCacheSize))
+	return cache, store.Close
+}
+
+// valueOr returns *v, or def if v is unset.
+func valueOr(v *int, def int) int {
+	if v == nil {
+		return def
+	}
+	return *v
+}
+
+// packObjectsCacheLimits returns the size and age limits of the pack-objects
+// cache entries. Zero disables a limit.
+func packObjectsCacheLimits(configFile goblet.ConfigFile) (int64, time.Duration) {
+	maxBytes, maxAge := int64(packobjects.DefaultMaxBytes), packobjects.DefaultMaxAge
+	if mb := configFile.PackObjectsCacheMaxSizeMB; mb != 0 {
+		maxBytes = int64(max(mb, 0)) << 20
+	}
+	if s := configFile.PackObjectsCacheMaxAgeSeconds; s != 0 {
+		maxAge = time.Duration(max(s, 0)) * time.Second
+	}
+	return maxBytes, maxAge
+}
+
+// cleanPackObjectsCache evicts the pack-objects cache entries exceeding the
+// limits of the configuration file, and reports the outcomes of the hook runs
+// since the previous cleanup.
+func cleanPackObjectsCache(configFile goblet.ConfigFile, metrics goblet.Metrics) {
+	cache := &packobjects.Cache{
+		Dir:          configFile.PackObjectsCache,
+		StaleTimeout: time.Duration(configFile.PackObjectsCacheStaleTimeoutSeconds) * time.Second,
+	}
+	stats, err := cache.Clean(packObjectsCacheLimits(configFile))
+	if err != nil {
+		slog.Error("Pack-objects cache cleanup failed", "err", err)
+		return
+	}
+	if metrics != nil {
+		metrics.Gauge("goblet.packobjects.cache.bytes", float64(stats.Bytes), nil)
+		metrics.Gauge("goblet.packobjects.cache.entries", float64(stats.Entries), nil)
+		metrics.Count("goblet.packobjects.cache.evictions", int64(stats.Evicted), nil)
+		metrics.Count("goblet.packobjects.cache.abandoned", int64(stats.Abandoned), nil)
+	}
+	outcomes, err := cache.TakeOutcomes()
+	if err != nil {
+		slog.Error("Cannot read the pack-objects cache outcomes", "err", err)
+	} else if metrics != nil {
+		for outcome, n := range map[string]int{
+			"hit":      outcomes.Hits,
+			"tail":     outcomes.Tails,
+			"miss":     outcomes.Misses,
+			"fallback": outcomes.Fallbacks,
+		} {
+			metrics.Count("goblet.packobjects.cache.runs", int64(n), []string{"outcome:" + outcome})
+		}
+	}
+	if stats.Evicted > 0 || stats.Abandoned > 0 {
+		slog.Info("Evicted pack-objects cache entries",
+			"evicted", stats.Evicted,
+			"evicted_bytes", stats.EvictedBytes,
+			"abandoned", stats.Abandoned,
+			"entries", stats.Entries,
+			"bytes", stats.Bytes)
+	}
+}
+
+// openLogFile opens path for appending, rotating it once it exceeds
+// maxSizeMB (100 by default). The path "stdout" stands for the standard
+// output.
+func openLogFile(path string, maxSizeMB, maxBackups int) (io.WriteCloser, error) {
+	if path == "stdout" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	return goblet.NewRotatingFile(path, int64(cmp.Or(maxSizeMB, 100))<<20, maxBackups)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// newLogger returns the logger writing to stderr in the format and at the
+// levels of the configuration file.
+func newLogger(configFile goblet.ConfigFile) *slog.Logger {
+	// The handler lets through the lowest of the levels, so that the
+	// subsystems can be more verbose than the rest.
+	minLevel := configFile.LogLevel
+	for _, subsystem := range []string{goblet.LogServer, goblet.LogRepository, goblet.LogAuth, goblet.LogGitHub} {
+		level, ok := configFile.LogLevels[subsystem]
+		if !ok {
+			level = configFile.LogLevel
+		}
+		goblet.SetLogLevel(subsystem, level)
+		minLevel = min(minLevel, level)
+	}
+
+	options := &slog.HandlerOptions{Level: minLevel}
+	var handler slog.Handler
+	if configFile.LogFormat == goblet.LogFormatText {
+		handler = slog.NewTextHandler(os.Stderr, options)
+	} else {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	logger := slog.New(handler)
+	if hostname, err := os.Hostname(); err == nil {
+		logger = logger.With("host", hostname)
+	}
+	return logger
+}
+
 type logBasedOperation struct {
-	action string
-	u      *url.URL
+	logger *slog.Logger
 }
 
 func (op *logBasedOperation) Printf(format string, a ...any) {
-	// log.Printf("Progress %s (%s): %s", op.action, op.u.String(), fmt.Sprintf(format, a...))
+	op.logger.Debug("Operation progress", "progress", strings.TrimSpace(fmt.Sprintf(format, a...)))
 }
 
 func (op *logBasedOperation) Done(err error) {
-	log.Printf("Finished %s for %s: %v", op.action, op.u.String(), err)
+	op.logger.Info("Finished an operation", "err", err)
 }
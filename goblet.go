@@ -19,8 +19,8 @@ import (
 	"archive/tar"
 	"compress/gzip"
 	"context"
+	"crypto/subtle"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
@@ -33,7 +33,10 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/oauth2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var (
@@ -77,15 +80,83 @@ type ServerConfig struct {
 
 	TokenSource oauth2.TokenSource
 
+	// CredentialPassthrough makes the upstream calls done on behalf of a
+	// request (ls-refs and on-demand fetches) use the client's own
+	// credential instead of TokenSource. TokenSource is still used for the
+	// background fetches. Since the shared mirror is served to any client
+	// that passes RequestAuthorizer, the authorizer must confirm that the
+	// client has access to the requested repository upstream.
+	CredentialPassthrough bool
+
 	ErrorReporter func(*http.Request, error)
 
 	RequestLogger func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration)
 
 	LongRunningOperationLogger func(string, *url.URL) RunningOperation
 
+	// AuditLogger, if set, is called once per ls-refs and fetch command
+	// served. See NewJSONAuditLogger.
+	AuditLogger func(*AuditEntry)
+
+	// PackObjectsHook is the uploadpack.packObjectsHook of upload-pack,
+	// e.g. packobjects.HookCommandLine of the server binary. It caches the
+	// packs in PackObjectsCache.
 	PackObjectsHook string
 
 	PackObjectsCache string
+
+	// PackObjectsStaleTimeout is how long the hook can write a cache entry
+	// for, before it is considered abandoned. packobjects.DefaultStaleTimeout
+	// if zero.
+	PackObjectsStaleTimeout time.Duration
+
+	// BundleDir is where the clone bundles of managed repositories are
+	// stored. Bundles are advertised through the bundle-uri capability
+	// only when both BundleDir and BundleURL are set.
+	BundleDir string
+
+	// BundleURL is the base URL under which clients can reach
+	// BundleHandler.
+	BundleURL string
+
+	// BundleMaxAge is the minimum age of a clone bundle before it gets
+	// regenerated after a background fetch.
+	BundleMaxAge time.Duration
+
+	// GitBinary is the path of the git binary, the one found in PATH if
+	// empty. See CheckGitVersion.
+	GitBinary string
+
+	// Metrics records the ad-hoc metrics, e.g. NewStatsdMetrics. They are
+	// dropped if unset.
+	Metrics Metrics
+
+	// TracerProvider creates the spans of the requests and of the work
+	// they wait for, e.g. upstream fetches. Spans are dropped if unset.
+	TracerProvider trace.TracerProvider
+}
+
+func (c *ServerConfig) gitBinary() string {
+	if c.GitBinary == "" {
+		return "git"
+	}
+	return c.GitBinary
+}
+
+func (c *ServerConfig) metrics() Metrics {
+	if c.Metrics == nil {
+		return NoopMetrics{}
+	}
+	return c.Metrics
+}
+
+// URLTokenSource is a TokenSource that can mint a token specific to an
+// upstream repository. When ServerConfig.TokenSource implements it, Goblet
+// uses TokenForURL with the canonical upstream URL for every upstream call.
+type URLTokenSource interface {
+	oauth2.TokenSource
+
+	TokenForURL(*url.URL) (*oauth2.Token, error)
 }
 
 type RunningOperation interface {
@@ -141,13 +212,13 @@ func FetchManagedRepositoryAsync(config *ServerConfig, u *url.URL, mustFetch boo
 	if !mustFetch {
 		pendingFetches := repo.fetchUpstreamPool.WaitingTasks()
 		if pendingFetches > 0 {
-			log.Printf("FetchManagedRepository skipped since there are %d pending fetches (%s)\n", pendingFetches, repo.localDiskPath)
+			repo.logger().Debug("Background fetch skipped since fetches are pending", "pending", pendingFetches)
 			errorChan <- nil
 			return
 		}
 		elapsedSinceLastUpdate := time.Since(repo.LastUpdateTime())
 		if elapsedSinceLastUpdate < 15*time.Minute {
-			log.Printf("FetchManagedRepository skipped since repo was updated %s ago (%s)\n", elapsedSinceLastUpdate, repo.localDiskPath)
+			repo.logger().Debug("Background fetch skipped since the repository is fresh", "staleness", elapsedSinceLastUpdate)
 			errorChan <- nil
 			return
 		}
@@ -155,29 +226,36 @@ func FetchManagedRepositoryAsync(config *ServerConfig, u *url.URL, mustFetch boo
 
 	fetchStartTime := time.Now()
 	repo.fetchUpstreamPool.Submit(func() {
-		logElapsed("FetchManagedRepository queuing", fetchStartTime, time.Minute, repo.localDiskPath)
+		repo.logElapsed("FetchManagedRepository queuing", fetchStartTime, time.Minute)
 
 		if mustFetch {
-			log.Printf("FetchManagedRepository required since mustFetch is set (%s)\n", repo.localDiskPath)
-			StatsdClient.Incr("goblet.operation.count", []string{"dir:" + repo.localDiskPath, "op:background_fetch", "must:1"}, 1)
-			errorChan <- repo.fetchUpstream(nil)
+			repo.logger().Debug("Background fetch required")
+			repo.config.metrics().Count("goblet.operation.count", 1, []string{"dir:" + repo.localDiskPath, "op:background_fetch", "must:1"})
+			err := repo.fetchUpstream(context.Background(), nil)
+			errorChan <- err
+			if err == nil {
+				go repo.updateBundle()
+			}
 		} else {
 			// check again when the task is picked up
 			elapsedSinceLastUpdate := time.Since(repo.LastUpdateTime())
 			if elapsedSinceLastUpdate < 15*time.Minute {
-				log.Printf("FetchManagedRepository skipped since repo was updated %s ago (%s)\n", elapsedSinceLastUpdate, repo.localDiskPath)
+				repo.logger().Debug("Background fetch skipped since the repository is fresh", "staleness", elapsedSinceLastUpdate)
 				errorChan <- nil
 			} else {
-				log.Printf("FetchManagedRepository required since repo was not updated for %s (%s)\n", elapsedSinceLastUpdate, repo.localDiskPath)
-				StatsdClient.Incr("goblet.operation.count", []string{"dir:" + repo.localDiskPath, "op:background_fetch", "must:0"}, 1)
-				errorChan <- repo.fetchUpstream(nil)
+				repo.logger().Debug("Background fetch required since the repository is stale", "staleness", elapsedSinceLastUpdate)
+				repo.config.metrics().Count("goblet.operation.count", 1, []string{"dir:" + repo.localDiskPath, "op:background_fetch", "must:0"})
+				err := repo.fetchUpstream(context.Background(), nil)
+				errorChan <- err
+				if err == nil {
+					go repo.updateBundle()
+				}
 			}
 		}
 
 		// log gc.log content if any
 		if content, err := os.ReadFile(path.Join(repo.localDiskPath, "gc.log")); err == nil {
-			log.Printf("Found git gc log file (content:%s, dir:%s)\n", strings.ReplaceAll(string(content), "\n", " "), repo.localDiskPath)
-			log.Print("Running git gc b/c gc.log file was found")
+			repo.logger().Warn("Running git gc since gc.log was found", "gc_log", strings.ReplaceAll(string(content), "\n", " "))
 			errorChan <- repo.runGC()
 		}
 	})
@@ -208,6 +286,40 @@ func NoOpRequestAuthorizer(request *http.Request) error {
 	return nil
 }
 
+// NewStaticTokenRequestAuthorizer returns a request authorizer that accepts
+// requests carrying one of the given tokens, either as a bearer token or as
+// the password of HTTP basic authentication.
+func NewStaticTokenRequestAuthorizer(tokens []string) func(*http.Request) error {
+	return func(request *http.Request) error {
+		token := ""
+		if _, password, ok := request.BasicAuth(); ok {
+			token = password
+		} else if after, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer "); ok {
+			token = after
+		}
+		if token == "" {
+			return status.Error(codes.Unauthenticated, "request not authenticated")
+		}
+
+		authorized := false
+		for _, t := range tokens {
+			// Go through all the tokens so that the time taken doesn't
+			// tell which one almost matched.
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				authorized = true
+			}
+		}
+		if !authorized {
+			return status.Error(codes.PermissionDenied, "access denied")
+		}
+
+		// Ensures that the token isn't leaked further down the chain.
+		request.Header.Del("Authorization")
+		SetPrincipal(request, "static:"+CredentialFingerprint(token))
+		return nil
+	}
+}
+
 func seedRepository(config *ServerConfig, repository *managedRepository) error {
 	bucket := os.Getenv("FIGMA_CI_CACHE_BUCKET")
 	key := "figma.tar"
@@ -215,7 +327,7 @@ func seedRepository(config *ServerConfig, repository *managedRepository) error {
 	var ctx = context.Background()
 	client, err := getS3Client(ctx)
 	if err != nil {
-		log.Println("Could not get S3 client")
+		repository.logger().Error("Cannot get the S3 client", "err", err)
 		return err
 	}
 
@@ -225,7 +337,7 @@ func seedRepository(config *ServerConfig, repository *managedRepository) error {
 		Key:    &key,
 	})
 	if err != nil {
-		log.Println("Could not get the object")
+		repository.logger().Error("Cannot get the seed archive", "bucket", bucket, "key", key, "err", err)
 		return err
 	}
 	defer output.Body.Close()
@@ -233,7 +345,7 @@ func seedRepository(config *ServerConfig, repository *managedRepository) error {
 	// Create a gzip reader
 	gr, err := gzip.NewReader(output.Body)
 	if err != nil {
-		log.Println("Could not get the gzip reader")
+		repository.logger().Error("Cannot decompress the seed archive", "key", key, "err", err)
 		return err
 	}
 	defer gr.Close()
@@ -268,7 +380,7 @@ func seedRepository(config *ServerConfig, repository *managedRepository) error {
 		outFile.Close()
 	}
 
-	log.Println("Extracted", key)
+	repository.logger().Info("Extracted the seed archive", "key", key)
 	return nil
 }
 
@@ -17,13 +17,16 @@ package goblet
 import (
 	"compress/gzip"
 	"io"
-	"log"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/google/gitprotocolio"
 	"go.opencensus.io/tag"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -43,6 +46,15 @@ func (s *httpProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		r.URL.Scheme = "https"
 	}
 
+	ctx := traceContext.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := s.config.tracer().Start(ctx, "goblet.request",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.HTTPMethodKey.String(r.Method), semconv.HTTPTargetKey.String(r.URL.Path)))
+	defer span.End()
+	// The request state is set before logHTTPRequest, so that the
+	// RequestLogger sees what is learnt while serving the request.
+	r = r.WithContext(withRequestState(ctx))
+
 	w, logCloser := logHTTPRequest(s.config, w, r)
 	defer logCloser()
 	reporter := &httpErrorReporter{config: s.config, req: r, w: w}
@@ -59,15 +71,33 @@ func (s *httpProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if len(ci_source) == 0 {
 		ci_source = r.UserAgent()
 	}
+	updateRequestState(ctx, func(s *requestState) { s.ciSource = ci_source })
 
 	// Technically, this server is an HTTP proxy, and it should use
 	// Proxy-Authorization / Proxy-Authenticate. However, existing
 	// authentication mechanism around Git is not compatible with proxy
 	// authorization. We use normal authentication mechanism here.
-	if err := s.config.RequestAuthorizer(r); err != nil {
+	//
+	// The authorizer may strip the credential off the request, so take it
+	// beforehand.
+	var passthroughToken *oauth2.Token
+	if s.config.CredentialPassthrough {
+		if passthroughToken, err = clientTokenFromRequest(r); err != nil {
+			reporter.reportError(err)
+			return
+		}
+	}
+	_, authSpan := s.config.tracer().Start(r.Context(), "authorize")
+	err = s.config.RequestAuthorizer(r)
+	endSpan(authSpan, err)
+	if err != nil {
 		reporter.reportError(err)
 		return
 	}
+	span.SetAttributes(principalKey.String(PrincipalFromContext(r.Context())), ciSourceKey.String(ci_source))
+	if passthroughToken != nil {
+		r = r.WithContext(withClientToken(r.Context(), passthroughToken))
+	}
 	if proto := r.Header.Get("Git-Protocol"); proto != "version=2" {
 		reporter.reportError(status.Errorf(codes.InvalidArgument, "accepts only Git protocol v2, received %v", proto))
 		return
@@ -96,8 +126,11 @@ func (s *httpProxyServer) infoRefsHandler(reporter *httpErrorReporter, w http.Re
 		// See managed_repositories.go for not having ref-in-want.
 		{Capabilities: []string{"fetch=filter shallow"}},
 		{Capabilities: []string{"server-option"}},
-		{EndOfRequest: true},
 	}
+	if u, err := s.config.URLCanonicalizer(r.URL); err == nil && hasBundle(s.config, u) {
+		rs = append(rs, &gitprotocolio.InfoRefsResponseChunk{Capabilities: []string{"bundle-uri"}})
+	}
+	rs = append(rs, &gitprotocolio.InfoRefsResponseChunk{EndOfRequest: true})
 	for _, pkt := range rs {
 		if err := writePacket(w, pkt); err != nil {
 			// Client-side IO error. Treat this as Canceled.
@@ -141,21 +174,53 @@ func (s *httpProxyServer) uploadPackHandler(reporter *httpErrorReporter, w http.
 		reporter.reportError(err)
 		return
 	}
+	updateRequestState(r.Context(), func(s *requestState) { s.repository = repo.upstreamURL.String() })
 
 	gitReporter := &gitProtocolHTTPErrorReporter{config: s.config, req: r, w: w}
 	for i, command := range commands {
 		tags := generateV2RequestMetricTags(command, repo)
 		startTime := time.Now()
-		if !handleV2Command(r.Context(), gitReporter, repo, command, w, ci_source) {
-			log.Printf("Failed to handle V2 Request (command %d/%d) (CI: %s, repo:%s)\n", i+1, len(commands), ci_source, repo.upstreamURL)
+		var cmdReporter gitProtocolErrorReporter = gitReporter
+		cw := &countingWriter{w: w}
+		var entry *AuditEntry
+		if s.config.AuditLogger != nil && (command[0].Command == "ls-refs" || command[0].Command == "fetch") {
+			entry = &AuditEntry{
+				Time:       startTime,
+				Principal:  PrincipalFromContext(r.Context()),
+				CISource:   ci_source,
+				Repository: repo.upstreamURL.String(),
+				Command:    command[0].Command,
+			}
+			if wantHashes, wantRefs, err := parseFetchWants(command); err == nil {
+				entry.Wants = len(wantHashes) + len(wantRefs)
+			}
+			cmdReporter = &auditingReporter{reporter: gitReporter, entry: entry}
+		}
+		ctx, span := repo.startSpan(r.Context(), "git "+command[0].Command)
+		ok := handleV2Command(ctx, cmdReporter, repo, command, cw, ci_source)
+		span.End()
+		if entry != nil {
+			entry.BytesServed = cw.n
+			entry.DurationMS = time.Since(startTime).Milliseconds()
+			s.config.AuditLogger(entry)
+		}
+		if !ok {
 			duration := time.Since(startTime)
+			Logger(LogServer).Warn("Failed to handle a V2 request",
+				"repo", repo.upstreamURL.String(),
+				"command", command[0].Command,
+				"command_index", i+1,
+				"commands", len(commands),
+				"ci_source", ci_source,
+				"principal", PrincipalFromContext(r.Context()),
+				"duration", duration)
 			tags = append(tags, "success:0")
-			StatsdClient.Distribution("goblet.v2request.dist", duration.Seconds(), tags, 1)
+			s.config.metrics().Distribution("goblet.v2request.dist", duration.Seconds(), tags)
 			return
 		} else {
 			duration := time.Since(startTime)
 			tags = append(tags, "success:1")
-			StatsdClient.Distribution("goblet.v2request.dist", duration.Seconds(), tags, 1)
+			s.config.metrics().Distribution("goblet.v2request.dist", duration.Seconds(), tags)
 		}
 	}
 }
@@ -179,6 +244,7 @@ func parseAllCommands(r io.Reader) ([][]*gitprotocolio.ProtocolV2RequestChunk, e
 		switch chunks[0].Command {
 		case "ls-refs":
 		case "fetch":
+		case "bundle-uri":
 			// Do nothing.
 		default:
 			return nil, status.Errorf(codes.InvalidArgument, "unrecognized command: %v", chunks[0])
@@ -0,0 +1,70 @@
+package goblet
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// Log subsystems, whose verbosity can be set separately with SetLogLevel.
+const (
+	// LogServer covers the inbound requests and their Git commands.
+	LogServer = "server"
+
+	// LogRepository covers the work done on the cached repositories, e.g.
+	// upstream fetches, upload-pack and bundles.
+	LogRepository = "repository"
+
+	// LogAuth covers the request authorizers and the TLS certificates.
+	LogAuth = "auth"
+
+	// LogGitHub covers the GitHub App tokens and the GitHub API calls.
+	LogGitHub = "github"
+)
+
+// *slog.LevelVar map keyed by a subsystem.
+var logLevels sync.Map
+
+// SetLogLevel sets the minimum level of the logs of subsystem, Info by
+// default.
+func SetLogLevel(subsystem string, level slog.Level) {
+	logLevel(subsystem).Set(level)
+}
+
+func logLevel(subsystem string) *slog.LevelVar {
+	v, _ := logLevels.LoadOrStore(subsystem, new(slog.LevelVar))
+	return v.(*slog.LevelVar)
+}
+
+// Logger returns the logger of subsystem. It writes to the handler of
+// slog.Default, so that programs embedding Goblet choose the output format.
+func Logger(subsystem string) *slog.Logger {
+	return slog.New(&levelHandler{level: logLevel(subsystem), handler: slog.Default().Handler()}).With("subsystem", subsystem)
+}
+
+// levelHandler drops the records below level.
+type levelHandler struct {
+	level   slog.Leveler
+	handler slog.Handler
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level() && h.handler.Enabled(ctx, level)
+}
+
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler.Handle(ctx, r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{level: h.level, handler: h.handler.WithAttrs(attrs)}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{level: h.level, handler: h.handler.WithGroup(name)}
+}
+
+// logger returns the logger of the work done on r.
+func (r *managedRepository) logger() *slog.Logger {
+	return Logger(LogRepository).With("repo", r.upstreamURL.String(), "dir", r.localDiskPath)
+}
@@ -21,53 +21,42 @@ import (
 	"fmt"
 	"io"
 
-	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/DataDog/datadog-go/statsd"
 	"github.com/alitto/pond"
+	"github.com/canva/goblet/packobjects"
 	"github.com/google/gitprotocolio"
 	git "github.com/libgit2/git2go/v34"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/oauth2"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+// lastUpdateFileName is the file of a local repository holding its last
+// update time.
+const lastUpdateFileName = "goblet-last-update"
+
 var (
-	gitBinary string
 	// *managedRepository map keyed by a cached repository path.
 	managedRepos sync.Map
 
 	ErrReferenceNotFound   = errors.New("reference not found")
 	ErrReferenceInvalid    = errors.New("reference is not valid")
 	serveFetchLocalCounter int32
-	StatsdClient           *statsd.Client
 )
 
-func init() {
-	var err error
-
-	gitBinary, err = exec.LookPath("git")
-	if err != nil {
-		log.Fatal("Cannot find the git binary: ", err)
-	}
-
-	StatsdClient, err = statsd.New("127.0.0.1:8125")
-	if err != nil {
-		log.Fatal("Cannot initialize statsd client: ", err)
-	}
-}
-
 func getManagedRepo(localDiskPath string, u *url.URL, config *ServerConfig) *managedRepository {
 	newM := &managedRepository{
 		localDiskPath: localDiskPath,
@@ -78,14 +67,13 @@ func getManagedRepo(localDiskPath string, u *url.URL, config *ServerConfig) *man
 	m, loaded := managedRepos.LoadOrStore(localDiskPath, newM)
 	ret := m.(*managedRepository)
 	if !loaded {
-		log.Printf("FetchUpstreamPool created for %s\n", localDiskPath)
+		logger := ret.logger()
+		logger.Debug("Creating the worker pools")
 		ret.fetchUpstreamPool = pond.New(1, 1000, pond.IdleTimeout(5*time.Minute), pond.PanicHandler(func(p any) {
-			log.Printf("Fetch upstream task panicked: %v\n", p)
+			logger.Error("Fetch upstream task panicked", "panic", p)
 		}))
-
-		log.Printf("ServeFetchPool created for %s\n", localDiskPath)
 		ret.serveFetchPool = pond.New(100, 1000, pond.IdleTimeout(5*time.Minute), pond.PanicHandler(func(p any) {
-			log.Printf("Serve fetch task panicked: %v\n", p)
+			logger.Error("Serve fetch task panicked", "panic", p)
 		}))
 
 		ret.mu.Unlock()
@@ -104,35 +92,39 @@ func openManagedRepository(config *ServerConfig, u *url.URL) (*managedRepository
 	m := getManagedRepo(localDiskPath, u, config)
 
 	m.once.Do(func() {
-		log.Printf("Initializing local Git repository %s\n", localDiskPath)
+		logger := m.logger()
+		logger.Debug("Initializing the local Git repository")
 		if _, err := os.Stat(localDiskPath); err != nil {
 			if !os.IsNotExist(err) {
-				log.Fatalf("error while initializing local Git repository %s: %v", localDiskPath, err)
+				logger.Error("Cannot initialize the local Git repository", "err", err)
+				os.Exit(1)
 			}
 
 			if err := os.MkdirAll(localDiskPath, 0750); err != nil {
-				log.Fatalf("cannot create a cache dir %s: %v", localDiskPath, err)
+				logger.Error("Cannot create the cache dir", "err", err)
+				os.Exit(1)
 			}
 
 			op := noopOperation{}
 			var gitVersionBuilder strings.Builder
-			runGitWithStdOut(op, &gitVersionBuilder, localDiskPath, "--version")
+			m.runGitWithStdOut(op, &gitVersionBuilder, "--version")
 			gitVersion := strings.TrimPrefix(strings.TrimSpace(gitVersionBuilder.String()), "git version ")
 			userAgent := fmt.Sprintf("git/%s goblet/1.0", gitVersion)
 
-			runGit(op, localDiskPath, "init", "--bare")
-			runGit(op, localDiskPath, "config", "protocol.version", "2")
-			runGit(op, localDiskPath, "config", "uploadpack.allowfilter", "1")
-			runGit(op, localDiskPath, "config", "uploadpack.allowrefinwant", "1")
-			runGit(op, localDiskPath, "config", "repack.writebitmaps", "1")
-			runGit(op, localDiskPath, "config", "http.userAgent", userAgent)
-			runGit(op, localDiskPath, "config", "http.version", "HTTP/2")
-			runGit(op, localDiskPath, "remote", "add", "--mirror=fetch", "origin", u.String())
+			m.runGit(op, "init", "--bare")
+			m.runGit(op, "config", "protocol.version", "2")
+			m.runGit(op, "config", "uploadpack.allowfilter", "1")
+			m.runGit(op, "config", "uploadpack.allowrefinwant", "1")
+			m.runGit(op, "config", "repack.writebitmaps", "1")
+			m.runGit(op, "config", "http.userAgent", userAgent)
+			m.runGit(op, "config", "http.version", "HTTP/2")
+			m.runGit(op, "remote", "add", "--mirror=fetch", "origin", u.String())
 
-			log.Printf("Created and configured local Git repository (git:%s, dir:%s)\n", gitVersion, localDiskPath)
+			logger.Info("Created and configured the local Git repository", "git", gitVersion)
 		} else {
-			log.Printf("Local Git repository %s already exists. Skipped configuration\n", localDiskPath)
+			logger.Debug("Local Git repository already exists, skipped configuration")
 		}
+		m.restoreLastUpdateTime()
 	})
 
 	return m, nil
@@ -153,17 +145,17 @@ func logStats(command string, startTime time.Time, err error) {
 	)
 }
 
-func logElapsed(operation string, startTime time.Time, threshold time.Duration, localDiskPath string) {
+func (r *managedRepository) logElapsed(operation string, startTime time.Time, threshold time.Duration) {
 	elapsed := time.Since(startTime)
 	if elapsed > threshold {
-		log.Printf("%s took too long (%s %s)\n", operation, elapsed, localDiskPath)
+		r.logger().Warn("Operation took too long", "op", operation, "duration", elapsed)
 	}
 
 	tags := []string{
-		"dir:" + localDiskPath,
+		"dir:" + r.localDiskPath,
 		"op:" + strings.ToLower(strings.ReplaceAll(operation, " ", "_")),
 	}
-	StatsdClient.Timing("goblet.operation.time", elapsed, tags, 1)
+	r.config.metrics().Timing("goblet.operation.time", elapsed, tags)
 }
 
 type managedRepository struct {
@@ -175,14 +167,19 @@ type managedRepository struct {
 	once              sync.Once
 	fetchUpstreamPool *pond.WorkerPool
 	serveFetchPool    *pond.WorkerPool
+	bundling          int32
+	uploadPacks       int32
 }
 
-func (r *managedRepository) lsRefsUpstream(command []*gitprotocolio.ProtocolV2RequestChunk) ([]*gitprotocolio.ProtocolV2ResponseChunk, error) {
+func (r *managedRepository) lsRefsUpstream(ctx context.Context, command []*gitprotocolio.ProtocolV2RequestChunk) (_ []*gitprotocolio.ProtocolV2ResponseChunk, err error) {
+	ctx, span := r.startSpan(ctx, "lsRefsUpstream", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { endSpan(span, err) }()
+
 	req, err := http.NewRequest("POST", r.upstreamURL.String()+"/git-upload-pack", newGitRequest(command))
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "cannot construct a request object: %v", err)
 	}
-	t, err := r.config.TokenSource.Token()
+	t, err := r.upstreamToken(ctx)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "cannot obtain an OAuth2 access token for the server: %v", err)
 	}
@@ -194,15 +191,14 @@ func (r *managedRepository) lsRefsUpstream(command []*gitprotocolio.ProtocolV2Re
 	startTime := time.Now()
 	resp, err := http.DefaultClient.Do(req)
 	logStats("ls-refs", startTime, err)
-	logElapsed("lsRefsUpstream", startTime, time.Minute, r.localDiskPath)
+	r.logElapsed("lsRefsUpstream", startTime, time.Minute)
 	if err != nil {
-		log.Printf("ls-refs request failed (dir:%s, err:%v)\n", r.localDiskPath, err)
+		r.logger().Error("ls-refs request failed", "err", err)
 		return nil, status.Errorf(codes.Internal, "cannot send a request to the upstream: %v", err)
 	}
 	defer resp.Body.Close()
 
-	// Log response headers
-	log.Printf("ls-refs response (dir:%s, status:%d, headers:%v)\n", r.localDiskPath, resp.StatusCode, resp.Header)
+	r.logger().Debug("ls-refs response", "status", resp.StatusCode, "headers", resp.Header)
 
 	if resp.StatusCode != http.StatusOK {
 		errMessage := ""
@@ -210,8 +206,7 @@ func (r *managedRepository) lsRefsUpstream(command []*gitprotocolio.ProtocolV2Re
 		if err == nil {
 			errMessage = string(bs)
 		}
-		log.Printf("ls-refs failed with non-OK response (dir:%s, status:%d, content-type:%s, error:%s)\n",
-			r.localDiskPath, resp.StatusCode, resp.Header.Get("Content-Type"), errMessage)
+		r.logger().Error("ls-refs failed with a non-OK response", "status", resp.StatusCode, "content_type", resp.Header.Get("Content-Type"), "body", errMessage)
 		return nil, fmt.Errorf("got a non-OK response from the upstream: %v %s", resp.StatusCode, errMessage)
 	}
 
@@ -232,48 +227,56 @@ func (r *managedRepository) runGC() error {
 	defer r.mu.Unlock()
 
 	op := r.startOperation("gitGC")
-	err := runGit(op, r.localDiskPath, "gc", "--prune='15.minutes.ago'")
+	err := r.runGit(op, "gc", "--prune='15.minutes.ago'")
 	op.Done(err)
 
 	return err
 }
 
-func (r *managedRepository) fetchUpstream(additionalWants []git.Oid) (err error) {
+// fetchUpstream fetches from the upstream with the credential of the client in
+// ctx, if any, or with the server's otherwise.
+func (r *managedRepository) fetchUpstream(ctx context.Context, additionalWants []git.Oid) (err error) {
 	var t *oauth2.Token
 	lockTime := time.Now()
+	_, lockSpan := r.startSpan(ctx, "fetchUpstream lock")
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	lockSpan.End()
 	logStats("fetchBlocked", lockTime, nil)
 
+	ctx, span := r.startSpan(ctx, "fetchUpstream", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { endSpan(span, err) }()
+
 	startTime := time.Now()
-	defer logElapsed("fetchUpstream", startTime, time.Minute, r.localDiskPath)
+	defer r.logElapsed("fetchUpstream", startTime, time.Minute)
 
 	staled := startTime.Sub(r.LastUpdateTime())
 	if staled < time.Hour*24*365 {
 		// do not report if it's more than one year old
-		StatsdClient.Gauge("goblet.stale.seconds", staled.Seconds(), []string{"dir:" + r.localDiskPath}, 1)
+		r.config.metrics().Gauge("goblet.stale.seconds", staled.Seconds(), []string{"dir:" + r.localDiskPath})
 		if staled > time.Hour {
-			log.Printf("Repo has staled for %s (dir:%s)\n", staled, r.localDiskPath)
+			r.logger().Warn("Repository is stale", "staleness", staled)
 		}
 	}
 
-	t, err = r.config.TokenSource.Token()
+	t, err = r.upstreamToken(ctx)
 	if err != nil {
 		err = status.Errorf(codes.Internal, "cannot obtain an OAuth2 access token for the server: %v", err)
+		recentFetchErrors.add(r.upstreamURL.String(), time.Now(), err)
 		return err
 	}
 	err = r.fetchUpstreamInternal("origin", t, additionalWants)
 	endTime := time.Now()
 	duration := endTime.Sub(startTime)
-	StatsdClient.Distribution("goblet.fetchupstream.dist", duration.Seconds(), []string{"dir:" + r.localDiskPath}, 1)
-
-	log.Printf("FetchUpstream finished (lock:%s, run:%s, err:%v, dir:%s)\n", startTime.Sub(lockTime), duration, err, r.localDiskPath)
+	r.config.metrics().Distribution("goblet.fetchupstream.dist", duration.Seconds(), []string{"dir:" + r.localDiskPath})
 
 	logStats("fetch", startTime, err)
 	if err == nil {
-		atomic.StoreInt64(&r.lastUpdateUnix, startTime.Unix())
+		r.setLastUpdateTime(startTime)
+		r.logger().Info("FetchUpstream succeeded", "lock_wait", startTime.Sub(lockTime), "duration", duration)
 	} else {
-		log.Printf("FetchUpstream failed. (token_exp:%s, dir:%s, err:%v)\n", t.Expiry, r.localDiskPath, err)
+		r.logger().Error("FetchUpstream failed", "lock_wait", startTime.Sub(lockTime), "duration", duration, "token_expiry", t.Expiry, "err", err)
+		recentFetchErrors.add(r.upstreamURL.String(), endTime, err)
 	}
 
 	return err
@@ -296,6 +299,7 @@ func (r *managedRepository) fetchUpstreamInternal(remote string, token *oauth2.T
 	args = append(args, "--no-write-fetch-head")
 	args = append(args, "--prune")
 	args = append(args, "--no-tags")
+	args = append(args, "--progress")
 
 	// remote
 	args = append(args, remote)
@@ -307,25 +311,35 @@ func (r *managedRepository) fetchUpstreamInternal(remote string, token *oauth2.T
 		// only the first want will be appended
 		args = append(args, additionalWants[0].String())
 		if len(additionalWants) > 1 {
-			log.Printf("Additional wants %s... ignored in git fetch refspec\n", additionalWants[1].String())
+			r.logger().Debug("Additional wants ignored in the git fetch refspec", "ignored", len(additionalWants)-1)
 		}
 	}
 
 	op := r.startOperation("FetchUpstream")
-	err := runGit(op, r.localDiskPath, args...)
+	err := r.runGit(op, args...)
 	op.Done(err)
 
 	// mask token before logging
 	args[tokenArgIndex] = "[redacted]"
 	if err != nil {
-		log.Printf("FetchUpstream git command failed (cmd:git %s, dir:%s, err:%v)\n", strings.Join(args, " "), r.localDiskPath, err)
+		r.logger().Error("FetchUpstream git command failed", "cmd", "git "+strings.Join(args, " "), "err", err)
 	} else {
-		log.Printf("FetchUpstream git command succeeded (cmd:git %s, dir:%s)\n", strings.Join(args, " "), r.localDiskPath)
+		r.logger().Debug("FetchUpstream git command succeeded", "cmd", "git "+strings.Join(args, " "))
 	}
 
 	return err
 }
 
+func (r *managedRepository) upstreamToken(ctx context.Context) (*oauth2.Token, error) {
+	if t, ok := clientToken(ctx); ok {
+		return t, nil
+	}
+	if ts, ok := r.config.TokenSource.(URLTokenSource); ok {
+		return ts.TokenForURL(r.upstreamURL)
+	}
+	return r.config.TokenSource.Token()
+}
+
 func (r *managedRepository) UpstreamURL() *url.URL {
 	u := *r.upstreamURL
 	return &u
@@ -336,6 +350,25 @@ func (r *managedRepository) LastUpdateTime() time.Time {
 	return time.Unix(lastUpdateUnix, 0)
 }
 
+// setLastUpdateTime sets LastUpdateTime, and persists it in the repository
+// so that it survives restarts and snapshot imports.
+func (r *managedRepository) setLastUpdateTime(t time.Time) {
+	atomic.StoreInt64(&r.lastUpdateUnix, t.Unix())
+	if err := os.WriteFile(filepath.Join(r.localDiskPath, lastUpdateFileName), []byte(t.UTC().Format(time.RFC3339)+"\n"), 0644); err != nil {
+		r.logger().Warn("Cannot persist the last update time", "err", err)
+	}
+}
+
+func (r *managedRepository) restoreLastUpdateTime() {
+	bs, err := os.ReadFile(filepath.Join(r.localDiskPath, lastUpdateFileName))
+	if err != nil {
+		return
+	}
+	if t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(bs))); err == nil {
+		atomic.StoreInt64(&r.lastUpdateUnix, t.Unix())
+	}
+}
+
 func (r *managedRepository) RecoverFromBundle(bundlePath string) (err error) {
 	op := r.startOperation("ReadBundle")
 	defer func() {
@@ -344,7 +377,7 @@ func (r *managedRepository) RecoverFromBundle(bundlePath string) (err error) {
 
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	err = runGit(op, r.localDiskPath, "fetch", "--progress", "-f", bundlePath, "refs/*:refs/*")
+	err = r.runGit(op, "fetch", "--progress", "-f", bundlePath, "refs/*:refs/*")
 	return
 }
 
@@ -353,7 +386,7 @@ func (r *managedRepository) WriteBundle(w io.Writer) (err error) {
 	defer func() {
 		op.Done(err)
 	}()
-	err = runGitWithStdOut(op, w, r.localDiskPath, "bundle", "create", "-", "--all")
+	err = r.runGitWithStdOut(op, w, "bundle", "create", "-", "--all")
 	return
 }
 
@@ -361,7 +394,7 @@ func (r *managedRepository) hasAnyUpdate(refs map[string]git.Oid) (bool, error)
 	var err error
 	startTime := time.Now()
 	defer logStats("hasAnyUpdate", startTime, err)
-	defer logElapsed("hasAnyUpdate", startTime, 2*time.Second, r.localDiskPath)
+	defer r.logElapsed("hasAnyUpdate", startTime, 2*time.Second)
 
 	// log.Printf("Comparing refs of %d\n", len(refs))
 
@@ -378,7 +411,7 @@ func (r *managedRepository) hasAnyUpdate(refs map[string]git.Oid) (bool, error)
 	defer odb.Free()
 
 	for refName, expectedHash := range refs {
-		ref, err := lookupReference(repo, refName, true)
+		ref, err := r.lookupReference(repo, refName, true)
 		if err == ErrReferenceNotFound {
 			return true, nil
 		} else if err != nil {
@@ -388,9 +421,9 @@ func (r *managedRepository) hasAnyUpdate(refs map[string]git.Oid) (bool, error)
 			if odb.Exists(&expectedHash) {
 				// If the expectedHash exists in local repo, it means the local repo is actually ahead of the refs pair
 				// In this case, hasAnyUpdate should return false and FetchUpstream is not necessary.
-				log.Printf("Comparing and hash not matched but exists %s %s %s\n", refName, expectedHash.String(), ref.Target().String())
+				r.logger().Debug("Ref behind an existing object", "ref", refName, "want", expectedHash.String(), "have", ref.Target().String())
 			} else {
-				log.Printf("Comparing and hash not matched %s %s %s\n", refName, expectedHash.String(), ref.Target().String())
+				r.logger().Debug("Ref behind a missing object", "ref", refName, "want", expectedHash.String(), "have", ref.Target().String())
 				return true, nil
 			}
 		}
@@ -402,7 +435,7 @@ func (r *managedRepository) hasAllWants(hashes []git.Oid, refs []string) (bool,
 	var err error
 	startTime := time.Now()
 	defer logStats("hasAllWants", startTime, err)
-	defer logElapsed("hasAllWants", startTime, 2*time.Second, r.localDiskPath)
+	defer r.logElapsed("hasAllWants", startTime, 2*time.Second)
 
 	// log.Printf("Searching hashes of %d and refs of %d\n", len(hashes), len(refs))
 
@@ -428,7 +461,7 @@ func (r *managedRepository) hasAllWants(hashes []git.Oid, refs []string) (bool,
 	}
 
 	for _, refName := range refs {
-		if _, err := lookupReference(repo, refName, true); err == ErrReferenceNotFound {
+		if _, err := r.lookupReference(repo, refName, true); err == ErrReferenceNotFound {
 			return false, nil
 		} else if err != nil {
 			return false, fmt.Errorf("error while looking up a reference for want check: %v", err)
@@ -438,7 +471,10 @@ func (r *managedRepository) hasAllWants(hashes []git.Oid, refs []string) (bool,
 	return true, nil
 }
 
-func (r *managedRepository) serveFetchLocal(command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer, ci_source string) error {
+func (r *managedRepository) serveFetchLocal(ctx context.Context, command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer, ci_source string) (err error) {
+	_, span := r.startSpan(ctx, "upload-pack")
+	defer func() { endSpan(span, err) }()
+
 	// If fetch-upstream is running, it's possible that Git returns
 	// incomplete set of objects when the refs being fetched is updated and
 	// it uses ref-in-want.
@@ -449,16 +485,19 @@ func (r *managedRepository) serveFetchLocal(command []*gitprotocolio.ProtocolV2R
 	if r.config.PackObjectsHook != "" {
 		args = append(args, "-c")
 		args = append(args, fmt.Sprintf("uploadpack.packObjectsHook=%s", r.config.PackObjectsHook))
-		env = append(env, fmt.Sprintf("POH_CACHE_DIR=%s", r.config.PackObjectsCache))
-		env = append(env, fmt.Sprintf("POH_STDIN_MAX=%d", 1500))
-		env = append(env, fmt.Sprintf("POH_CI_SOURCE=%s", ci_source))
+		cache := &packobjects.Cache{
+			Dir:           r.config.PackObjectsCache,
+			MaxStdinBytes: 1500,
+			StaleTimeout:  r.config.PackObjectsStaleTimeout,
+		}
+		env = append(env, packobjects.HookEnv(cache, ci_source)...)
 	}
 
 	args = append(args, "upload-pack")
 	args = append(args, "--stateless-rpc")
 	args = append(args, r.localDiskPath)
 
-	cmd := exec.Command(gitBinary, args...)
+	cmd := exec.Command(r.config.gitBinary(), args...)
 	cmd.Env = env
 	cmd.Dir = r.localDiskPath
 	cmd.Stdin = newGitRequest(command)
@@ -466,47 +505,51 @@ func (r *managedRepository) serveFetchLocal(command []*gitprotocolio.ProtocolV2R
 	cmd.Stderr = os.Stderr
 
 	startTime := time.Now()
-	defer logElapsed("serveFetchLocal", startTime, time.Minute, r.localDiskPath)
+	defer r.logElapsed("serveFetchLocal", startTime, time.Minute)
 
 	atomic.AddInt32(&serveFetchLocalCounter, 1)
 	defer atomic.AddInt32(&serveFetchLocalCounter, -1)
+	atomic.AddInt32(&r.uploadPacks, 1)
+	defer atomic.AddInt32(&r.uploadPacks, -1)
 
-	err := cmd.Run()
+	err = cmd.Run()
 	elapsed := time.Since(startTime)
 	counter := atomic.LoadInt32(&serveFetchLocalCounter)
-	StatsdClient.Gauge("goblet.operation.concurrency", float64(counter), []string{"dir:" + r.localDiskPath, "op:servefetchlocal"}, 1)
+	r.config.metrics().Gauge("goblet.operation.concurrency", float64(counter), []string{"dir:" + r.localDiskPath, "op:servefetchlocal"})
 
+	logger := r.logger().With("ci_source", ci_source, "principal", PrincipalFromContext(ctx), "duration", elapsed, "concurrency", counter)
 	if err != nil {
-		log.Printf("ServeFetchLocal failed (run:%s, err:%v, counter:%d, dir:%s)\n", elapsed, err, counter, r.localDiskPath)
+		logger.Error("ServeFetchLocal failed", "err", err)
 	} else {
-		log.Printf("ServeFetchLocal succeeded (run:%s, counter:%d, dir:%s)\n", elapsed, counter, r.localDiskPath)
+		logger.Info("ServeFetchLocal succeeded")
 	}
 	return err
 }
 
 func (r *managedRepository) startOperation(op string) RunningOperation {
+	var ret RunningOperation = noopOperation{}
 	if r.config.LongRunningOperationLogger != nil {
-		return r.config.LongRunningOperationLogger(op, r.upstreamURL)
+		ret = r.config.LongRunningOperationLogger(op, r.upstreamURL)
 	}
-	return noopOperation{}
+	return &trackedOperation{id: operations.start(op, r.upstreamURL), op: ret}
 }
 
-func lookupReference(repo *git.Repository, refName string, resolve bool) (*git.Reference, error) {
+func (r *managedRepository) lookupReference(repo *git.Repository, refName string, resolve bool) (*git.Reference, error) {
 	if valid, _ := git.ReferenceNameIsValid(refName); !valid {
-		log.Printf("Searching ref and got invalid ref %s\n", refName)
+		r.logger().Debug("Invalid ref", "ref", refName)
 		return nil, ErrReferenceInvalid
 	}
 
 	ref, err := repo.References.Lookup(refName)
 	if err != nil {
-		log.Printf("Searching ref and not found %s %v\n", refName, err)
+		r.logger().Debug("Ref not found", "ref", refName, "err", err)
 		return nil, ErrReferenceNotFound
 	}
 
 	if resolve {
 		ref, err = ref.Resolve()
 		if err != nil {
-			log.Printf("Searching ref and not resolved %s %v\n", refName, err)
+			r.logger().Debug("Ref not resolved", "ref", refName, "err", err)
 			return nil, ErrReferenceNotFound
 		}
 	}
@@ -514,10 +557,10 @@ func lookupReference(repo *git.Repository, refName string, resolve bool) (*git.R
 	return ref, nil
 }
 
-func runGit(op RunningOperation, gitDir string, arg ...string) error {
-	cmd := exec.Command(gitBinary, arg...)
+func (r *managedRepository) runGit(op RunningOperation, arg ...string) error {
+	cmd := exec.Command(r.config.gitBinary(), arg...)
 	cmd.Env = []string{}
-	cmd.Dir = gitDir
+	cmd.Dir = r.localDiskPath
 	cmd.Stderr = &operationWriter{op}
 	cmd.Stdout = &operationWriter{op}
 	if err := cmd.Run(); err != nil {
@@ -526,11 +569,11 @@ func runGit(op RunningOperation, gitDir string, arg ...string) error {
 	return nil
 }
 
-func runGitWithStdOut(op RunningOperation, w io.Writer, gitDir string, arg ...string) error {
-	log.Printf("(runGitWithStdOut) Running git %s on %s\n", strings.Join(arg, " "), gitDir)
-	cmd := exec.Command(gitBinary, arg...)
+func (r *managedRepository) runGitWithStdOut(op RunningOperation, w io.Writer, arg ...string) error {
+	r.logger().Debug("Running git", "cmd", "git "+strings.Join(arg, " "))
+	cmd := exec.Command(r.config.gitBinary(), arg...)
 	cmd.Env = []string{}
-	cmd.Dir = gitDir
+	cmd.Dir = r.localDiskPath
 	cmd.Stdout = w
 	cmd.Stderr = &operationWriter{op}
 	if err := cmd.Run(); err != nil {
@@ -539,6 +582,44 @@ func runGitWithStdOut(op RunningOperation, w io.Writer, gitDir string, arg ...st
 	return nil
 }
 
+// MinimumGitVersion is the oldest git supported. Upstream fetches rely on
+// --no-write-fetch-head and negative refspecs, both added in 2.29.
+var MinimumGitVersion = [3]int{2, 29, 0}
+
+// CheckGitVersion returns the version of gitBinary, or an error if it is
+// older than MinimumGitVersion. An empty gitBinary is the git found in PATH.
+func CheckGitVersion(gitBinary string) (string, error) {
+	if gitBinary == "" {
+		gitBinary = "git"
+	}
+	out, err := exec.Command(gitBinary, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("cannot run %s: %v", gitBinary, err)
+	}
+	version := strings.TrimPrefix(strings.TrimSpace(string(out)), "git version ")
+
+	var got [3]int
+	for i, part := range strings.SplitN(version, ".", 3) {
+		// Skip suffixes such as "2.39.5 (Apple Git-154)" or "2.40.0.windows.1".
+		digits := strings.IndexFunc(part, func(r rune) bool { return r < '0' || r > '9' })
+		if digits >= 0 {
+			part = part[:digits]
+		}
+		if got[i], err = strconv.Atoi(part); err != nil {
+			return version, fmt.Errorf("cannot parse the git version %q", version)
+		}
+	}
+	for i := range got {
+		if got[i] != MinimumGitVersion[i] {
+			if got[i] < MinimumGitVersion[i] {
+				return version, fmt.Errorf("git %s is older than the minimum supported version %d.%d.%d", version, MinimumGitVersion[0], MinimumGitVersion[1], MinimumGitVersion[2])
+			}
+			break
+		}
+	}
+	return version, nil
+}
+
 func newGitRequest(command []*gitprotocolio.ProtocolV2RequestChunk) io.Reader {
 	b := new(bytes.Buffer)
 	for _, c := range command {
@@ -0,0 +1,198 @@
+package goblet
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics records the ad-hoc metrics of Goblet, such as
+// "goblet.operation.time". Tags are "key:value" strings, as in statsd.
+type Metrics interface {
+	Count(name string, value int64, tags []string)
+	Gauge(name string, value float64, tags []string)
+	Distribution(name string, value float64, tags []string)
+	Timing(name string, value time.Duration, tags []string)
+}
+
+// NoopMetrics drops every metric.
+type NoopMetrics struct{}
+
+func (NoopMetrics) Count(string, int64, []string)          {}
+func (NoopMetrics) Gauge(string, float64, []string)        {}
+func (NoopMetrics) Distribution(string, float64, []string) {}
+func (NoopMetrics) Timing(string, time.Duration, []string) {}
+
+type statsdMetrics struct {
+	client *statsd.Client
+}
+
+// NewStatsdMetrics returns Metrics sent to a statsd agent, e.g. the Datadog
+// agent.
+func NewStatsdMetrics(client *statsd.Client) Metrics {
+	return &statsdMetrics{client: client}
+}
+
+func (m *statsdMetrics) Count(name string, value int64, tags []string) {
+	m.client.Count(name, value, tags, 1)
+}
+
+func (m *statsdMetrics) Gauge(name string, value float64, tags []string) {
+	m.client.Gauge(name, value, tags, 1)
+}
+
+func (m *statsdMetrics) Distribution(name string, value float64, tags []string) {
+	m.client.Distribution(name, value, tags, 1)
+}
+
+func (m *statsdMetrics) Timing(name string, value time.Duration, tags []string) {
+	m.client.Timing(name, value, tags, 1)
+}
+
+// prometheusLabels lists the tag keys of the metrics recorded by Goblet.
+// Prometheus requires every sample of a metric to have the same labels, so
+// missing tags are exported as empty labels. The metrics not listed here take
+// the tag keys of their first sample.
+var prometheusLabels = map[string][]string{
+	"goblet.authentication.failed": {"reason"},
+	"goblet.operation.count":       {"dir", "op", "must", "triggered_by"},
+	"goblet.operation.time":        {"dir", "op"},
+	"goblet.operation.concurrency": {"dir", "op"},
+	"goblet.stale.seconds":         {"dir"},
+	"goblet.fetchupstream.dist":    {"dir"},
+	"goblet.v2request.dist":        {"repo", "command", "success"},
+}
+
+type prometheusMetrics struct {
+	registerer prometheus.Registerer
+
+	mu         sync.Mutex
+	counters   map[string]*prometheus.CounterVec
+	gauges     map[string]*prometheus.GaugeVec
+	histograms map[string]*prometheus.HistogramVec
+	labels     map[string][]string
+}
+
+// NewPrometheusMetrics returns Metrics registered to registerer. Metric names
+// have their dots replaced with underscores, e.g. "goblet_operation_count".
+// Distributions are exported as histograms, and timings as histograms in
+// seconds with a "_seconds" suffix.
+func NewPrometheusMetrics(registerer prometheus.Registerer) Metrics {
+	return &prometheusMetrics{
+		registerer: registerer,
+		counters:   map[string]*prometheus.CounterVec{},
+		gauges:     map[string]*prometheus.GaugeVec{},
+		histograms: map[string]*prometheus.HistogramVec{},
+		labels:     map[string][]string{},
+	}
+}
+
+func (m *prometheusMetrics) Count(name string, value int64, tags []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, ok := m.counters[name]
+	if !ok {
+		v = m.registerLocked(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: prometheusName(name),
+			Help: name,
+		}, m.labelsLocked(name, tags))).(*prometheus.CounterVec)
+		m.counters[name] = v
+	}
+	v.WithLabelValues(m.labelValuesLocked(name, tags)...).Add(float64(value))
+}
+
+func (m *prometheusMetrics) Gauge(name string, value float64, tags []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, ok := m.gauges[name]
+	if !ok {
+		v = m.registerLocked(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: prometheusName(name),
+			Help: name,
+		}, m.labelsLocked(name, tags))).(*prometheus.GaugeVec)
+		m.gauges[name] = v
+	}
+	v.WithLabelValues(m.labelValuesLocked(name, tags)...).Set(value)
+}
+
+func (m *prometheusMetrics) Distribution(name string, value float64, tags []string) {
+	m.observe(name, prometheusName(name), value, tags)
+}
+
+func (m *prometheusMetrics) Timing(name string, value time.Duration, tags []string) {
+	m.observe(name, prometheusName(name)+"_seconds", value.Seconds(), tags)
+}
+
+func (m *prometheusMetrics) observe(name, promName string, value float64, tags []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, ok := m.histograms[name]
+	if !ok {
+		v = m.registerLocked(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: promName,
+			Help: name,
+			// From 10ms to about 45 minutes.
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 19),
+		}, m.labelsLocked(name, tags))).(*prometheus.HistogramVec)
+		m.histograms[name] = v
+	}
+	v.WithLabelValues(m.labelValuesLocked(name, tags)...).Observe(value)
+}
+
+// registerLocked registers c, or returns the collector already registered
+// under the same name.
+func (m *prometheusMetrics) registerLocked(c prometheus.Collector) prometheus.Collector {
+	if err := m.registerer.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+		panic(err)
+	}
+	return c
+}
+
+func (m *prometheusMetrics) labelsLocked(name string, tags []string) []string {
+	if labels, ok := m.labels[name]; ok {
+		return labels
+	}
+	labels, ok := prometheusLabels[name]
+	if !ok {
+		for _, t := range tags {
+			if k, _, ok := strings.Cut(t, ":"); ok {
+				labels = append(labels, k)
+			}
+		}
+	}
+	m.labels[name] = labels
+	return labels
+}
+
+// labelValuesLocked returns the values of the labels of name found in tags.
+// Tags whose key isn't a label are dropped.
+func (m *prometheusMetrics) labelValuesLocked(name string, tags []string) []string {
+	labels := m.labels[name]
+	values := make([]string, len(labels))
+	for _, t := range tags {
+		k, v, ok := strings.Cut(t, ":")
+		if !ok {
+			continue
+		}
+		for i, l := range labels {
+			if l == k {
+				values[i] = v
+				break
+			}
+		}
+	}
+	return values
+}
+
+func prometheusName(name string) string {
+	return strings.NewReplacer(".", "_", "-", "_").Replace(name)
+}
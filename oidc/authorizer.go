@@ -0,0 +1,317 @@
+// Package oidc authorizes requests carrying OIDC ID tokens, such as the
+// workload identity tokens minted by CI runners.
+package oidc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/canva/goblet"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	// Minimum delay between two reloads of the key set triggered by tokens
+	// signed with an unknown key.
+	keySetReloadInterval = time.Minute
+
+	jwksFetchTimeout = 10 * time.Second
+)
+
+// Asymmetric algorithms only. A key set is public; accepting HMAC would let
+// anyone holding it sign tokens.
+var allowedAlgorithms = map[string]bool{
+	string(jose.RS256): true, string(jose.RS384): true, string(jose.RS512): true,
+	string(jose.PS256): true, string(jose.PS384): true, string(jose.PS512): true,
+	string(jose.ES256): true, string(jose.ES384): true, string(jose.ES512): true,
+	string(jose.EdDSA): true,
+}
+
+// Rule allows the callers whose claims match Claims to fetch the repositories
+// matching Repositories.
+//
+// Claims maps a claim name to a path.Match pattern of its value, e.g.
+// {"repository": "canva/*", "ref": "refs/heads/main"}. Repositories are
+// path.Match patterns of "<host>/<path>" of the canonical upstream URL, matched
+// case-insensitively, and can refer to string claims as "{name}", e.g.
+// "github.com/{repository}".
+type Rule struct {
+	Claims       map[string]string `json:"claims"`
+	Repositories []string          `json:"repositories"`
+}
+
+type Config struct {
+	// Issuer and Audience are the expected "iss" and "aud" claims.
+	Issuer   string
+	Audience string
+
+	// The JSON Web Key Set verifying the tokens is read from JWKSFile, or
+	// fetched from JWKSURL.
+	JWKSFile string
+	JWKSURL  string
+
+	Rules []Rule
+
+	URLCanonicalizer func(*url.URL) (*url.URL, error)
+}
+
+type Authorizer struct {
+	config Config
+
+	// keySet is swapped once reloaded, so that the tokens signed with a
+	// known key are verified while the key set is being fetched.
+	keySet atomic.Pointer[jose.JSONWebKeySet]
+
+	mu         sync.Mutex
+	lastReload time.Time
+}
+
+// NewAuthorizer returns an Authorizer with the key set loaded.
+func NewAuthorizer(config Config) (*Authorizer, error) {
+	if config.Issuer == "" || config.Audience == "" {
+		return nil, fmt.Errorf("oidc issuer and audience must be provided")
+	}
+	if (config.JWKSFile == "") == (config.JWKSURL == "") {
+		return nil, fmt.Errorf("either oidc jwks file or jwks url must be provided")
+	}
+	if len(config.Rules) == 0 {
+		return nil, fmt.Errorf("oidc rules must be provided")
+	}
+	for _, rule := range config.Rules {
+		if len(rule.Repositories) == 0 {
+			return nil, fmt.Errorf("oidc rule %v allows no repository", rule.Claims)
+		}
+		for _, pattern := range rule.Claims {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid oidc claim pattern %q: %v", pattern, err)
+			}
+		}
+	}
+
+	a := &Authorizer{config: config}
+	keySet, err := a.loadKeySet()
+	if err != nil {
+		return nil, err
+	}
+	a.keySet.Store(keySet)
+	a.lastReload = time.Now()
+	goblet.Logger(goblet.LogAuth).Info("Loaded the OIDC key set", "keys", len(keySet.Keys), "issuer", config.Issuer)
+	return a, nil
+}
+
+func (a *Authorizer) RequestAuthorizer(req *http.Request) error {
+	token := ""
+	if _, password, ok := req.BasicAuth(); ok {
+		token = password
+	} else if after, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok {
+		token = after
+	}
+	if token == "" {
+		return status.Error(codes.Unauthenticated, "request not authenticated")
+	}
+
+	claims, err := a.verify(token)
+	if err != nil {
+		goblet.Logger(goblet.LogAuth).Info("OIDC token rejected", "err", err)
+		return status.Error(codes.Unauthenticated, "invalid token")
+	}
+
+	u, err := a.config.URLCanonicalizer(req.URL)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "cannot canonicalize the URL: %v", err)
+	}
+	if !a.allowed(claims, u.Host+u.Path) {
+		goblet.Logger(goblet.LogAuth).Info("OIDC token not allowed to fetch the repository", "repo", u.String(), "principal", claims["sub"])
+		return status.Error(codes.PermissionDenied, "access denied")
+	}
+
+	// Ensures that the token isn't leaked further down the chain.
+	req.Header.Del("Authorization")
+	if sub, ok := claims["sub"].(string); ok && sub != "" {
+		goblet.SetPrincipal(req, "oidc:"+sub)
+	} else {
+		goblet.SetPrincipal(req, "oidc:"+goblet.CredentialFingerprint(token))
+	}
+	return nil
+}
+
+// verify checks the signature and the registered claims of token, and returns
+// all of its claims.
+func (a *Authorizer) verify(token string) (map[string]any, error) {
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, err
+	}
+	if len(tok.Headers) != 1 {
+		return nil, fmt.Errorf("got %d signatures, want 1", len(tok.Headers))
+	}
+	header := tok.Headers[0]
+	if !allowedAlgorithms[header.Algorithm] {
+		return nil, fmt.Errorf("signing algorithm %q not allowed", header.Algorithm)
+	}
+
+	keys := a.keys(header.KeyID)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no key found for kid %q", header.KeyID)
+	}
+
+	var registered jwt.Claims
+	claims := map[string]any{}
+	for _, key := range keys {
+		if err = tok.Claims(key.Key, &registered, &claims); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if registered.Expiry == nil {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+	if err := registered.Validate(jwt.Expected{
+		Issuer:   a.config.Issuer,
+		Audience: jwt.Audience{a.config.Audience},
+		Time:     time.Now(),
+	}); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// keys returns the keys matching kid, reloading the key set if there's none,
+// e.g. after the issuer rotated its keys. The key set is fetched without
+// holding a.mu, and by a single caller at a time.
+func (a *Authorizer) keys(kid string) []jose.JSONWebKey {
+	if keys := matchingKeys(a.keySet.Load(), kid); len(keys) > 0 {
+		return keys
+	}
+
+	a.mu.Lock()
+	reload := time.Since(a.lastReload) > keySetReloadInterval
+	if reload {
+		a.lastReload = time.Now()
+	}
+	a.mu.Unlock()
+	if !reload {
+		// The key set may have been reloaded meanwhile.
+		return matchingKeys(a.keySet.Load(), kid)
+	}
+
+	keySet, err := a.loadKeySet()
+	if err != nil {
+		goblet.Logger(goblet.LogAuth).Error("OIDC key set reload failed", "err", err)
+		return nil
+	}
+	a.keySet.Store(keySet)
+	goblet.Logger(goblet.LogAuth).Info("Reloaded the OIDC key set", "keys", len(keySet.Keys))
+	return matchingKeys(keySet, kid)
+}
+
+func matchingKeys(keySet *jose.JSONWebKeySet, kid string) []jose.JSONWebKey {
+	if kid == "" {
+		return keySet.Keys
+	}
+	return keySet.Key(kid)
+}
+
+func (a *Authorizer) loadKeySet() (*jose.JSONWebKeySet, error) {
+	var bs []byte
+	var err error
+	if a.config.JWKSFile != "" {
+		bs, err = os.ReadFile(a.config.JWKSFile)
+	} else {
+		bs, err = fetchKeySet(a.config.JWKSURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keySet := &jose.JSONWebKeySet{}
+	if err := json.Unmarshal(bs, keySet); err != nil {
+		return nil, fmt.Errorf("cannot parse the oidc key set: %v", err)
+	}
+	return keySet, nil
+}
+
+func fetchKeySet(jwksURL string) ([]byte, error) {
+	client := &http.Client{Timeout: jwksFetchTimeout}
+	res, err := client.Get(jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cannot fetch the oidc key set: got %d from %s", res.StatusCode, jwksURL)
+	}
+	return io.ReadAll(res.Body)
+}
+
+var claimReference = regexp.MustCompile(`\{([^{}]+)\}`)
+
+func (a *Authorizer) allowed(claims map[string]any, repository string) bool {
+	for _, rule := range a.config.Rules {
+		if ruleAllows(rule, claims, repository) {
+			return true
+		}
+	}
+	return false
+}
+
+func ruleAllows(rule Rule, claims map[string]any, repository string) bool {
+	for name, pattern := range rule.Claims {
+		value, ok := claims[name]
+		if !ok {
+			return false
+		}
+		if matched, _ := path.Match(pattern, fmt.Sprint(value)); !matched {
+			return false
+		}
+	}
+
+	for _, pattern := range rule.Repositories {
+		missing := false
+		pattern = claimReference.ReplaceAllStringFunc(pattern, func(ref string) string {
+			value, ok := claims[ref[1:len(ref)-1]].(string)
+			if !ok {
+				missing = true
+				return ""
+			}
+			return escapePattern(value)
+		})
+		if missing {
+			continue
+		}
+		if matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(repository)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// escapePattern quotes the path.Match meta characters of a claim value, so
+// that a claim can only ever match itself.
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,192 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	testIssuer   = "https://ci.example.com"
+	testAudience = "goblet"
+)
+
+func newTestAuthorizer(t *testing.T, key *rsa.PrivateKey) *Authorizer {
+	bs, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: key.Public(), KeyID: "test", Algorithm: string(jose.RS256), Use: "sig"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(jwksFile, bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewAuthorizer(Config{
+		Issuer:   testIssuer,
+		Audience: testAudience,
+		JWKSFile: jwksFile,
+		Rules: []Rule{
+			{
+				Claims:       map[string]string{"repository": "canva/*", "ref": "refs/heads/main"},
+				Repositories: []string{"github.com/{repository}", "github.com/canva/shared-*"},
+			},
+		},
+		URLCanonicalizer: func(u *url.URL) (*url.URL, error) {
+			return &url.URL{Scheme: "https", Host: u.Host, Path: strings.TrimSuffix(u.Path, "/info/refs")}, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func signTestToken(t *testing.T, key *rsa.PrivateKey, kid string, issuer string, claims map[string]any) string {
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", kid),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	token, err := jwt.Signed(signer).Claims(jwt.Claims{
+		Issuer:   issuer,
+		Audience: jwt.Audience{testAudience},
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+	}).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestRequestAuthorizer(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newTestAuthorizer(t, key)
+
+	mainClaims := map[string]any{"repository": "canva/goblet", "ref": "refs/heads/main"}
+	for _, tc := range []struct {
+		name  string
+		token string
+		repo  string
+		want  codes.Code
+	}{
+		{"own repository", signTestToken(t, key, "test", testIssuer, mainClaims), "github.com/canva/goblet", codes.OK},
+		{"shared repository", signTestToken(t, key, "test", testIssuer, mainClaims), "github.com/canva/shared-tools", codes.OK},
+		{"other repository", signTestToken(t, key, "test", testIssuer, mainClaims), "github.com/canva/other", codes.PermissionDenied},
+		{"other ref", signTestToken(t, key, "test", testIssuer, map[string]any{"repository": "canva/goblet", "ref": "refs/heads/dev"}), "github.com/canva/goblet", codes.PermissionDenied},
+		{"wildcard claim", signTestToken(t, key, "test", testIssuer, map[string]any{"repository": "canva/*", "ref": "refs/heads/main"}), "github.com/canva/other", codes.PermissionDenied},
+		{"other issuer", signTestToken(t, key, "test", "https://evil.example.com", mainClaims), "github.com/canva/goblet", codes.Unauthenticated},
+		{"unknown key", signTestToken(t, otherKey, "test", testIssuer, mainClaims), "github.com/canva/goblet", codes.Unauthenticated},
+		{"no token", "", "github.com/canva/goblet", codes.Unauthenticated},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "https://"+tc.repo+"/info/refs", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			if got := status.Code(a.RequestAuthorizer(req)); got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRequestAuthorizer_DuringKeySetReload(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: key.Public(), KeyID: "test", Algorithm: string(jose.RS256), Use: "sig"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloading := make(chan struct{})
+	unblock := make(chan struct{})
+	requests := 0
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests > 1 {
+			close(reloading)
+			<-unblock
+		}
+		w.Write(bs)
+	}))
+	defer jwks.Close()
+	defer close(unblock)
+
+	a, err := NewAuthorizer(Config{
+		Issuer:   testIssuer,
+		Audience: testAudience,
+		JWKSURL:  jwks.URL,
+		Rules: []Rule{
+			{Claims: map[string]string{"repository": "canva/*"}, Repositories: []string{"github.com/{repository}"}},
+		},
+		URLCanonicalizer: func(u *url.URL) (*url.URL, error) {
+			return &url.URL{Scheme: "https", Host: u.Host, Path: strings.TrimSuffix(u.Path, "/info/refs")}, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.mu.Lock()
+	a.lastReload = time.Time{}
+	a.mu.Unlock()
+
+	authorize := func(token string) error {
+		req := httptest.NewRequest(http.MethodGet, "https://github.com/canva/goblet/info/refs", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return a.RequestAuthorizer(req)
+	}
+	claims := map[string]any{"repository": "canva/goblet"}
+	rotatedToken := signTestToken(t, otherKey, "rotated", testIssuer, claims)
+	knownToken := signTestToken(t, key, "test", testIssuer, claims)
+
+	// An unknown key triggers a reload, which hangs until the test ends.
+	go authorize(rotatedToken)
+	<-reloading
+
+	done := make(chan error, 1)
+	go func() { done <- authorize(knownToken) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("got %v, want OK", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a token signed with a known key waited for the key set reload")
+	}
+}
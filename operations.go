@@ -0,0 +1,267 @@
+package goblet
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of progress lines kept per operation.
+const maxProgressLines = 10
+
+// Number of events buffered per OperationEventsHandler client. The clients
+// that don't keep up are disconnected, and get the in-flight operations anew
+// when they reconnect.
+const operationEventsBuffer = 64
+
+// Maximum length of a progress line. Longer lines are split.
+const maxProgressLineLength = 4096
+
+// Operation is a long-running operation on a managed repository, e.g. an
+// upstream fetch.
+type Operation struct {
+	ID         int64     `json:"id"`
+	Action     string    `json:"action"`
+	Repository string    `json:"repository"`
+	StartTime  time.Time `json:"start_time"`
+
+	// Progress holds the latest lines written by git, e.g. "Receiving
+	// objects:  45% (450/1000)".
+	Progress []string `json:"progress"`
+
+	// Err is set once the operation failed.
+	Err string `json:"error,omitempty"`
+
+	// partial is the last line written by git, until it's terminated.
+	partial string
+}
+
+type operationEvent struct {
+	name string
+	op   Operation
+}
+
+// operationRegistry tracks the in-flight operations and broadcasts their
+// changes to the subscribers.
+type operationRegistry struct {
+	mu          sync.Mutex
+	nextID      int64
+	ops         map[int64]*Operation
+	subscribers map[chan operationEvent]bool
+}
+
+var operations = &operationRegistry{
+	ops:         map[int64]*Operation{},
+	subscribers: map[chan operationEvent]bool{},
+}
+
+func (g *operationRegistry) start(action string, u fmt.Stringer) int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.nextID++
+	op := &Operation{ID: g.nextID, Action: action, Repository: u.String(), StartTime: time.Now()}
+	g.ops[op.ID] = op
+	g.publishLocked("update", op)
+	return op.ID
+}
+
+func (g *operationRegistry) progress(id int64, output string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	op, ok := g.ops[id]
+	if !ok {
+		return
+	}
+	// git rewrites its progress lines with "\r". The output is written in
+	// chunks, which may end in the middle of a line.
+	output = op.partial + output
+	i := strings.LastIndexAny(output, "\r\n")
+	op.partial = output[i+1:]
+	if len(op.partial) > maxProgressLineLength {
+		i, op.partial = len(output), ""
+	}
+	if i < 0 {
+		return
+	}
+	op.addProgressLines(output[:i])
+	g.publishLocked("update", op)
+}
+
+func (op *Operation) addProgressLines(output string) {
+	for _, line := range strings.FieldsFunc(output, func(r rune) bool { return r == '\r' || r == '\n' }) {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if n := len(op.Progress); n > 0 && sameProgressStage(op.Progress[n-1], line) {
+			op.Progress[n-1] = line
+		} else {
+			op.Progress = append(op.Progress, line)
+		}
+	}
+	if len(op.Progress) > maxProgressLines {
+		op.Progress = op.Progress[len(op.Progress)-maxProgressLines:]
+	}
+}
+
+// sameProgressStage returns whether a and b report the progress of the same
+// stage, e.g. "Receiving objects:  45%" and "Receiving objects:  46%".
+func sameProgressStage(a, b string) bool {
+	stageA, _, okA := strings.Cut(a, ":")
+	stageB, _, okB := strings.Cut(b, ":")
+	return okA && okB && stageA == stageB
+}
+
+func (g *operationRegistry) done(id int64, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	op, ok := g.ops[id]
+	if !ok {
+		return
+	}
+	delete(g.ops, id)
+	op.addProgressLines(op.partial)
+	op.partial = ""
+	if err != nil {
+		op.Err = err.Error()
+	}
+	g.publishLocked("done", op)
+}
+
+func (g *operationRegistry) publishLocked(name string, op *Operation) {
+	if len(g.subscribers) == 0 {
+		return
+	}
+	event := operationEvent{name: name, op: copyOperation(op)}
+	for ch := range g.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// Dropping the event would leave the subscriber with a stale
+			// view, e.g. an operation that never ends.
+			delete(g.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns the in-flight operations, and a channel receiving their
+// subsequent changes until unsubscribe is called. The channel is closed if
+// the subscriber falls behind.
+func (g *operationRegistry) subscribe() ([]Operation, chan operationEvent, func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ch := make(chan operationEvent, operationEventsBuffer)
+	g.subscribers[ch] = true
+	return g.listLocked(), ch, func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		delete(g.subscribers, ch)
+	}
+}
+
+func (g *operationRegistry) list() []Operation {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.listLocked()
+}
+
+func (g *operationRegistry) listLocked() []Operation {
+	ret := make([]Operation, 0, len(g.ops))
+	for _, op := range g.ops {
+		ret = append(ret, copyOperation(op))
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret
+}
+
+func copyOperation(op *Operation) Operation {
+	ret := *op
+	ret.Progress = append([]string{}, op.Progress...)
+	return ret
+}
+
+// trackedOperation registers a RunningOperation in the registry of in-flight
+// operations.
+type trackedOperation struct {
+	id int64
+	op RunningOperation
+}
+
+func (t *trackedOperation) Printf(format string, a ...any) {
+	operations.progress(t.id, fmt.Sprintf(format, a...))
+	t.op.Printf(format, a...)
+}
+
+func (t *trackedOperation) Done(err error) {
+	operations.done(t.id, err)
+	t.op.Done(err)
+}
+
+// ListOperations returns the in-flight operations, oldest first.
+func ListOperations() []Operation {
+	return operations.list()
+}
+
+// OperationsHandler serves the in-flight operations as a JSON array.
+func OperationsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ListOperations())
+	})
+}
+
+// OperationEventsHandler streams the in-flight operations as server-sent
+// events: an "update" event with the operation as JSON when it starts or
+// progresses, and a "done" event when it ends. The operations in flight when
+// the client connects are sent first as "update" events.
+func OperationEventsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		ops, events, unsubscribe := operations.subscribe()
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		for _, op := range ops {
+			if err := writeOperationEvent(w, "update", op); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event, ok := <-events:
+				if !ok {
+					// The client fell behind. It resyncs when it
+					// reconnects.
+					return
+				}
+				if err := writeOperationEvent(w, event.name, event.op); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	})
+}
+
+func writeOperationEvent(w http.ResponseWriter, name string, op Operation) error {
+	bs, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, bs)
+	return err
+}
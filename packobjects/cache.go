@@ -0,0 +1,372 @@
+// Package packobjects caches the output of git pack-objects on disk, so that
+// identical fetches, e.g. the clones of many CI jobs, are served without
+// running pack-objects again. It implements the uploadpack.packObjectsHook
+// protocol: the hook is run with the pack-objects command line as arguments,
+// and its stdin and stdout are the ones of pack-objects.
+//
+// Each entry is a directory named after the SHA-256 of the command line and
+// stdin, "<dir>/<key[:2]>/<key[2:]>", which holds:
+//
+//   - start: created exclusively by the process writing the entry, whose pid,
+//     host and start time it holds;
+//   - stdout: the output of pack-objects, locked by the writer before it is
+//     renamed from a temporary name;
+//   - end: created once stdout is complete;
+//   - served: a line appended every time the entry is served.
+//
+// The writer holds an exclusive lock on stdout while writing it and the
+// readers a shared one while reading it, so that Clean never deletes an entry
+// in use. The entries whose writer died, or has been writing for longer than
+// StaleTimeout, are purged. The processes running the same pack-objects while
+// an entry is being written tail its stdout, instead of running pack-objects
+// again.
+//
+// Every run also appends its outcome, "hit", "tail", "miss" or "fallback", to
+// "<dir>/outcomes", which TakeOutcomes counts.
+package packobjects
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Interval at which the entries being written by another process are polled.
+const tailInterval = 20 * time.Millisecond
+
+// The outcomes of Run recorded in outcomesFile.
+const (
+	outcomesFile    = "outcomes"
+	outcomeHit      = "hit"
+	outcomeTail     = "tail"
+	outcomeMiss     = "miss"
+	outcomeFallback = "fallback"
+)
+
+// Cache is a pack-objects cache in a directory.
+type Cache struct {
+	Dir string
+
+	// MaxStdinBytes is the size of the largest stdin whose output is
+	// cached, unlimited if zero.
+	MaxStdinBytes int64
+
+	// StaleTimeout is how long an entry can be written for, before it is
+	// considered abandoned and purged. DefaultStaleTimeout if zero.
+	StaleTimeout time.Duration
+}
+
+// key returns the cache key of a pack-objects command line and stdin.
+func key(args []string, stdin []byte) string {
+	h := sha256.New()
+	fmt.Fprintln(h, strings.TrimSpace(strings.Join(args, " ")))
+	h.Write(stdin)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *Cache) path(key string, file ...string) string {
+	return filepath.Join(append([]string{c.Dir, key[:2], key[2:]}, file...)...)
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+// Run runs the pack-objects command line args with stdin, and writes its
+// output to stdout, from the cache if possible. ciSource is recorded in the
+// served log of the entry. It returns the exit code of pack-objects.
+func (c *Cache) Run(args []string, stdin io.Reader, stdout, stderr io.Writer, ciSource string) (int, error) {
+	if len(args) == 0 {
+		return 1, errors.New("no command to execute")
+	}
+	if err := os.MkdirAll(c.Dir, 0750); err != nil {
+		return 1, fmt.Errorf("cannot create the cache directory: %v", err)
+	}
+
+	var input bytes.Buffer
+	if _, err := io.Copy(&input, stdin); err != nil {
+		return 1, fmt.Errorf("cannot read stdin: %v", err)
+	}
+	key := key(args, input.Bytes())
+
+	if served, err := c.serve(key, stdout); served {
+		exitCode := 0
+		if err != nil {
+			exitCode = 1
+		}
+		c.recordServed(key, ciSource, exitCode)
+		c.recordOutcome(outcomeHit)
+		return exitCode, err
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = &input
+	cmd.Stderr = stderr
+	cmd.Stdout = stdout
+
+	entry := c.create(key, int64(input.Len()))
+	var tee *entryTee
+	if entry != nil {
+		tee = &entryTee{entry: entry.stdout, client: stdout}
+		cmd.Stdout = tee
+	} else if tailed, err := c.tail(key, stdout); tailed {
+		exitCode := 0
+		if err != nil {
+			exitCode = 1
+		}
+		c.recordServed(key, ciSource, exitCode)
+		c.recordOutcome(outcomeTail)
+		return exitCode, err
+	}
+
+	exitCode := 0
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitCode = exitErr.ExitCode()
+		err = nil
+	} else if err != nil {
+		exitCode = 1
+		err = fmt.Errorf("cannot execute %s: %v", cmd, err)
+	}
+
+	if entry != nil {
+		entry.finish(exitCode == 0 && tee.entryErr == nil)
+		if tee.clientErr != nil && err == nil {
+			exitCode = 1
+			err = fmt.Errorf("cannot write stdout: %v", tee.clientErr)
+		}
+		c.recordOutcome(outcomeMiss)
+	} else {
+		c.recordOutcome(outcomeFallback)
+	}
+	return exitCode, err
+}
+
+// entryTee writes the output of pack-objects to the entry being written and
+// to the client. The entry keeps being written if the client goes away, since
+// other processes may be tailing it, and conversely.
+type entryTee struct {
+	entry, client       io.Writer
+	entryErr, clientErr error
+}
+
+func (t *entryTee) Write(p []byte) (int, error) {
+	if t.entryErr == nil {
+		_, t.entryErr = t.entry.Write(p)
+	}
+	if t.clientErr == nil {
+		_, t.clientErr = t.client.Write(p)
+	}
+	if t.entryErr != nil && t.clientErr != nil {
+		return 0, t.clientErr
+	}
+	return len(p), nil
+}
+
+// serve copies the complete entry of key to w, if any. It returns whether the
+// entry was served, even partially.
+func (c *Cache) serve(key string, w io.Writer) (bool, error) {
+	if !fileExists(c.path(key, "end")) {
+		return false, nil
+	}
+	f, err := os.Open(c.path(key, "stdout"))
+	if err != nil {
+		// stdout is broken, purge the entry, unless someone else is
+		// taking care of it.
+		c.purgeUnlessLocked(key)
+		return false, nil
+	}
+	defer f.Close()
+	if err := lockShared(f); err != nil {
+		return false, nil
+	}
+	defer unlock(f)
+	// The entry may have been evicted while waiting for the lock.
+	if !fileExists(c.path(key, "end")) {
+		return false, nil
+	}
+	_, err = io.Copy(w, f)
+	return true, err
+}
+
+// tail copies the entry of key being written by another process to w, until
+// it is complete. It returns whether anything was written to w: if the writer
+// fails before, the caller can still run pack-objects itself.
+func (c *Cache) tail(key string, w io.Writer) (bool, error) {
+	// Without locks, a failed writer cannot be told from a slow one.
+	if !locksSupported || !fileExists(c.path(key, "start")) {
+		return false, nil
+	}
+	f, err := os.Open(c.path(key, "stdout"))
+	if err != nil {
+		return false, nil
+	}
+	defer f.Close()
+	// The writer locks stdout before it's visible. An incomplete entry that
+	// isn't locked is not being written, e.g. it was left by a process of
+	// another host, or by a writer that didn't lock it.
+	if ok, _ := tryLockShared(f); ok {
+		unlock(f)
+		if !fileExists(c.path(key, "end")) {
+			return false, nil
+		}
+	}
+
+	var written int64
+	for {
+		n, err := io.Copy(w, f)
+		written += n
+		if err != nil {
+			return true, err
+		}
+		if fileExists(c.path(key, "end")) {
+			// stdout was complete before end was created.
+			n, err := io.Copy(w, f)
+			return written+n > 0, err
+		}
+		// The writer holds its lock until it has created end, or purged
+		// the entry.
+		if ok, _ := tryLockShared(f); ok {
+			unlock(f)
+			if fileExists(c.path(key, "end")) {
+				continue
+			}
+			if written == 0 {
+				return false, nil
+			}
+			return true, errors.New("the writer of the cache entry failed")
+		}
+		time.Sleep(tailInterval)
+	}
+}
+
+func (c *Cache) recordServed(key, ciSource string, exitCode int) {
+	if f, err := os.OpenFile(c.path(key, "served"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err == nil {
+		fmt.Fprintln(f, time.Now().Format(time.RFC3339), ciSource, exitCode)
+		f.Close()
+	}
+}
+
+// recordOutcome appends outcome to the outcomes file of the cache, which the
+// janitor of the server reads since the hook runs in separate processes.
+func (c *Cache) recordOutcome(outcome string) {
+	if f, err := os.OpenFile(filepath.Join(c.Dir, outcomesFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err == nil {
+		fmt.Fprintln(f, outcome)
+		f.Close()
+	}
+}
+
+// entryWriter is an entry being written by this process.
+type entryWriter struct {
+	cache  *Cache
+	key    string
+	stdout *os.File
+}
+
+// create starts writing the entry of key, or returns nil if the output
+// shouldn't or cannot be cached.
+func (c *Cache) create(key string, stdinSize int64) *entryWriter {
+	if c.MaxStdinBytes != 0 && stdinSize > c.MaxStdinBytes {
+		return nil
+	}
+	if fileExists(c.path(key, "start")) && !c.purgeIfAbandoned(key) {
+		return nil
+	}
+	if err := os.MkdirAll(c.path(key), 0750); err != nil {
+		return nil
+	}
+
+	// The "start" file is created exclusively, so that only one process
+	// writes the entry. It identifies the process, so that the entry can be
+	// purged if the process dies.
+	fstart, err := os.OpenFile(c.path(key, "start"), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil
+	}
+	json.NewEncoder(fstart).Encode(currentOwner())
+	fstart.Close()
+
+	fstdout, err := c.createStdout(key)
+	if err != nil {
+		os.RemoveAll(c.path(key))
+		return nil
+	}
+	return &entryWriter{cache: c, key: key, stdout: fstdout}
+}
+
+// createStdout creates the stdout file of the entry of key, with an exclusive
+// lock. The file is locked under a temporary name, then renamed, so that the
+// tailers never find it unlocked while it is being written.
+func (c *Cache) createStdout(key string) (*os.File, error) {
+	if !locksSupported {
+		// Nobody tails the entries, and open files cannot be renamed on
+		// Windows.
+		return os.OpenFile(c.path(key, "stdout"), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	}
+	f, err := os.CreateTemp(c.path(key), "stdout-*")
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := tryLockExclusive(f); !ok || err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot lock %s: %v", f.Name(), err)
+	}
+	if err := os.Rename(f.Name(), c.path(key, "stdout")); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// finish completes the entry if ok, or purges it.
+func (e *entryWriter) finish(ok bool) {
+	defer e.stdout.Close()
+	defer unlock(e.stdout)
+	if ok {
+		if fend, err := os.OpenFile(e.cache.path(e.key, "end"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err == nil {
+			fmt.Fprintln(fend, time.Now().Format(time.RFC3339))
+			fend.Close()
+			return
+		}
+	}
+	e.cache.purge(e.key)
+}
+
+// purgeUnlessLocked purges the entry of key, unless it is being written or
+// read.
+func (c *Cache) purgeUnlessLocked(key string) bool {
+	f, err := os.Open(c.path(key, "stdout"))
+	if errors.Is(err, os.ErrNotExist) {
+		c.purge(key)
+		return true
+	} else if err != nil {
+		return false
+	}
+	defer f.Close()
+	if ok, err := tryLockExclusive(f); !ok || err != nil {
+		return false
+	}
+	defer unlock(f)
+	c.purge(key)
+	return true
+}
+
+// purge removes the entry of key. The caller must hold the exclusive lock of
+// its stdout, if any.
+func (c *Cache) purge(key string) {
+	// Remove "end" first, so that the entry isn't served anymore.
+	os.Remove(c.path(key, "end"))
+	os.RemoveAll(c.path(key))
+	// Remove the parent directory once empty.
+	os.Remove(filepath.Dir(c.path(key)))
+}
@@ -0,0 +1,221 @@
+package packobjects
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingCommand returns a command line that echoes its stdin and counts its
+// runs in a file.
+func countingCommand(t *testing.T) ([]string, func() int) {
+	counter := filepath.Join(t.TempDir(), "runs")
+	return []string{"sh", "-c", "echo run >> " + counter + "; cat"}, func() int {
+		bs, _ := os.ReadFile(counter)
+		return strings.Count(string(bs), "run")
+	}
+}
+
+func run(t *testing.T, c *Cache, args []string, stdin string) string {
+	t.Helper()
+	var stdout bytes.Buffer
+	exitCode, err := c.Run(args, strings.NewReader(stdin), &stdout, os.Stderr, "test")
+	if err != nil || exitCode != 0 {
+		t.Fatalf("got exit code %d, err %v", exitCode, err)
+	}
+	return stdout.String()
+}
+
+func TestRun_ServesFromCache(t *testing.T) {
+	c := &Cache{Dir: t.TempDir()}
+	args, runs := countingCommand(t)
+
+	for i := 0; i < 3; i++ {
+		if got := run(t, c, args, "want 1\n"); got != "want 1\n" {
+			t.Errorf("got %q, want the stdin echoed", got)
+		}
+	}
+	if got := runs(); got != 1 {
+		t.Errorf("got %d runs, want 1", got)
+	}
+
+	run(t, c, args, "want 2\n")
+	if got := runs(); got != 2 {
+		t.Errorf("got %d runs after a different stdin, want 2", got)
+	}
+}
+
+func TestRun_FailuresAreNotCached(t *testing.T) {
+	c := &Cache{Dir: t.TempDir()}
+	args := []string{"sh", "-c", "cat; exit 3"}
+
+	for i := 0; i < 2; i++ {
+		exitCode, err := c.Run(args, strings.NewReader("x"), &bytes.Buffer{}, &bytes.Buffer{}, "test")
+		if err != nil || exitCode != 3 {
+			t.Errorf("got exit code %d, err %v, want 3", exitCode, err)
+		}
+	}
+	if entries, _ := c.entries(); len(entries) != 0 {
+		t.Errorf("got %d entries, want none", len(entries))
+	}
+}
+
+func TestRun_MaxStdinBytes(t *testing.T) {
+	c := &Cache{Dir: t.TempDir(), MaxStdinBytes: 4}
+	args, runs := countingCommand(t)
+
+	run(t, c, args, "too long")
+	run(t, c, args, "too long")
+	if got := runs(); got != 2 {
+		t.Errorf("got %d runs, want 2", got)
+	}
+}
+
+func TestRun_TailsEntryBeingWritten(t *testing.T) {
+	c := &Cache{Dir: t.TempDir()}
+	counter := filepath.Join(t.TempDir(), "runs")
+	args := []string{"sh", "-c", "echo run >> " + counter + "; cat; sleep 0.5; echo end"}
+
+	first := make(chan string)
+	go func() {
+		var stdout bytes.Buffer
+		c.Run(args, strings.NewReader("want 1\n"), &stdout, os.Stderr, "first")
+		first <- stdout.String()
+	}()
+	for !fileExists(c.path(key(args, []byte("want 1\n")), "stdout")) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	second := run(t, c, args, "want 1\n")
+	if want := "want 1\nend\n"; second != want {
+		t.Errorf("got %q from the tailing process, want %q", second, want)
+	}
+	if got := <-first; got != second {
+		t.Errorf("got %q from the writing process, want %q", got, second)
+	}
+	if bs, _ := os.ReadFile(counter); strings.Count(string(bs), "run") != 1 {
+		t.Errorf("got %q runs, want 1", bs)
+	}
+}
+
+// failingWriter is a client that went away.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestRun_WriterClientGoesAway(t *testing.T) {
+	c := &Cache{Dir: t.TempDir()}
+	args := []string{"sh", "-c", "cat; sleep 0.5; echo end"}
+
+	first := make(chan int)
+	go func() {
+		exitCode, _ := c.Run(args, strings.NewReader("want 1\n"), failingWriter{}, os.Stderr, "first")
+		first <- exitCode
+	}()
+	for !fileExists(c.path(key(args, []byte("want 1\n")), "stdout")) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got, want := run(t, c, args, "want 1\n"), "want 1\nend\n"; got != want {
+		t.Errorf("got %q from the tailing process, want %q", got, want)
+	}
+	if exitCode := <-first; exitCode == 0 {
+		t.Error("got exit code 0 for the process whose client went away")
+	}
+	if !fileExists(c.path(key(args, []byte("want 1\n")), "end")) {
+		t.Error("the entry was not completed")
+	}
+}
+
+func TestRun_FallsBackWhenTheWriterFails(t *testing.T) {
+	c := &Cache{Dir: t.TempDir()}
+	counter := filepath.Join(t.TempDir(), "runs")
+	args := []string{"sh", "-c", "echo run >> " + counter + "; sleep 0.3; exit 1"}
+
+	first := make(chan int)
+	go func() {
+		exitCode, _ := c.Run(args, strings.NewReader("x"), &bytes.Buffer{}, os.Stderr, "first")
+		first <- exitCode
+	}()
+	for !fileExists(c.path(key(args, []byte("x")), "stdout")) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if exitCode, err := c.Run(args, strings.NewReader("x"), &bytes.Buffer{}, os.Stderr, "second"); exitCode != 1 || err != nil {
+		t.Errorf("got exit code %d, err %v, want the exit code of its own run", exitCode, err)
+	}
+	<-first
+	if bs, _ := os.ReadFile(counter); strings.Count(string(bs), "run") != 2 {
+		t.Errorf("got %q runs, want 2", bs)
+	}
+}
+
+// deadPID returns the pid of a process that exited.
+func deadPID(t *testing.T) int {
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestRun_RecoversAbandonedEntry(t *testing.T) {
+	c := &Cache{Dir: t.TempDir()}
+	args, runs := countingCommand(t)
+
+	// The writer was killed before creating end.
+	k := key(args, []byte("want 1\n"))
+	os.MkdirAll(c.path(k), 0750)
+	o := currentOwner()
+	o.PID = deadPID(t)
+	bs, _ := json.Marshal(o)
+	os.WriteFile(c.path(k, "start"), bs, 0644)
+	os.WriteFile(c.path(k, "stdout"), []byte("partial"), 0600)
+
+	for i := 0; i < 2; i++ {
+		if got := run(t, c, args, "want 1\n"); got != "want 1\n" {
+			t.Errorf("got %q, want the stdin echoed", got)
+		}
+	}
+	if got := runs(); got != 1 {
+		t.Errorf("got %d runs, want the entry cached again", got)
+	}
+}
+
+func TestRun_IgnoresUnlockedIncompleteEntry(t *testing.T) {
+	c := &Cache{Dir: t.TempDir()}
+	args, runs := countingCommand(t)
+
+	// The start file of a writer that didn't record its pid, e.g. of
+	// another host.
+	k := key(args, []byte("want 1\n"))
+	os.MkdirAll(c.path(k), 0750)
+	os.WriteFile(c.path(k, "start"), []byte(time.Now().Format(time.RFC3339)+"\n"), 0644)
+	os.WriteFile(c.path(k, "stdout"), []byte("partial"), 0600)
+
+	done := make(chan string)
+	go func() {
+		var stdout bytes.Buffer
+		c.Run(args, strings.NewReader("want 1\n"), &stdout, os.Stderr, "test")
+		done <- stdout.String()
+	}()
+	select {
+	case got := <-done:
+		if got != "want 1\n" {
+			t.Errorf("got %q, want the stdin echoed", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the unlocked entry was tailed")
+	}
+	if got := runs(); got != 1 {
+		t.Errorf("got %d runs, want 1", got)
+	}
+}
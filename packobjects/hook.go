@@ -0,0 +1,68 @@
+package packobjects
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HookCommand is the first argument of a program run as the pack-objects hook
+// by HookCommandLine, followed by the pack-objects command line.
+const HookCommand = "pack-objects-hook"
+
+// The environment variables through which the server configures the hook.
+const (
+	envCacheDir     = "POH_CACHE_DIR"
+	envStdinMax     = "POH_STDIN_MAX"
+	envStaleTimeout = "POH_STALE_TIMEOUT"
+	envCISource     = "POH_CI_SOURCE"
+)
+
+// HookCommandLine returns the uploadpack.packObjectsHook value that runs
+// executable as the hook, e.g. the server's own binary. Git runs the hook
+// through the shell.
+func HookCommandLine(executable string) string {
+	return "'" + strings.ReplaceAll(executable, "'", `'\''`) + "' " + HookCommand
+}
+
+// HookEnv returns the environment that makes the hook use c, and record
+// ciSource in the served logs.
+func HookEnv(c *Cache, ciSource string) []string {
+	env := []string{
+		envCacheDir + "=" + c.Dir,
+		envCISource + "=" + ciSource,
+	}
+	if c.MaxStdinBytes != 0 {
+		env = append(env, fmt.Sprintf("%s=%d", envStdinMax, c.MaxStdinBytes))
+	}
+	if c.StaleTimeout != 0 {
+		env = append(env, envStaleTimeout+"="+c.StaleTimeout.String())
+	}
+	return env
+}
+
+// RunHook runs the pack-objects command line args through the cache set by
+// HookEnv, with the standard input and outputs of the process. It returns
+// the exit code of the process.
+func RunHook(args []string) int {
+	dir, ok := os.LookupEnv(envCacheDir)
+	if !ok {
+		fmt.Fprintln(os.Stderr, envCacheDir+" not set.")
+		return 1
+	}
+	cache := &Cache{Dir: dir}
+	if v, err := strconv.ParseInt(os.Getenv(envStdinMax), 10, 0); err == nil {
+		cache.MaxStdinBytes = v
+	}
+	if v, err := time.ParseDuration(os.Getenv(envStaleTimeout)); err == nil {
+		cache.StaleTimeout = v
+	}
+
+	exitCode, err := cache.Run(args, os.Stdin, os.Stdout, os.Stderr, os.Getenv(envCISource))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return exitCode
+}
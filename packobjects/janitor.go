@@ -0,0 +1,180 @@
+package packobjects
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// The limits of the cache that the server applies by default.
+const (
+	DefaultMaxBytes = 10 << 30
+	DefaultMaxAge   = 24 * time.Hour
+)
+
+// CleanStats describes the cache after a Clean.
+type CleanStats struct {
+	// Entries and Bytes are what is left in the cache.
+	Entries int
+	Bytes   int64
+
+	Evicted      int
+	EvictedBytes int64
+
+	// Abandoned is the number of incomplete entries purged since their
+	// writer is gone.
+	Abandoned int
+}
+
+// Outcomes counts the runs of pack-objects through the cache.
+type Outcomes struct {
+	// Hits were served from a complete entry, and Tails from an entry
+	// being written by another process.
+	Hits  int
+	Tails int
+
+	// Misses wrote a new entry, and Fallbacks ran pack-objects without
+	// caching its output, e.g. since their stdin was too large.
+	Misses    int
+	Fallbacks int
+}
+
+// TakeOutcomes counts and removes the outcomes recorded since its previous
+// call. The runs finishing while it renames the outcomes file may be lost.
+func (c *Cache) TakeOutcomes() (Outcomes, error) {
+	var outcomes Outcomes
+	name := filepath.Join(c.Dir, outcomesFile)
+	taken := name + ".taken"
+	if err := os.Rename(name, taken); errors.Is(err, os.ErrNotExist) {
+		return outcomes, nil
+	} else if err != nil {
+		return outcomes, err
+	}
+	defer os.Remove(taken)
+
+	f, err := os.Open(taken)
+	if err != nil {
+		return outcomes, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		switch scanner.Text() {
+		case outcomeHit:
+			outcomes.Hits++
+		case outcomeTail:
+			outcomes.Tails++
+		case outcomeMiss:
+			outcomes.Misses++
+		case outcomeFallback:
+			outcomes.Fallbacks++
+		}
+	}
+	return outcomes, scanner.Err()
+}
+
+type entryInfo struct {
+	key      string
+	size     int64
+	created  time.Time
+	lastUsed time.Time
+	complete bool
+}
+
+// Clean purges the abandoned entries, and evicts the complete entries created
+// more than maxAge ago, then the least recently served ones until the cache
+// holds at most maxBytes. Zero disables either limit. The entries being
+// written or read are never evicted, so nothing is evicted on the platforms
+// without file locks, where they cannot be told apart.
+func (c *Cache) Clean(maxBytes int64, maxAge time.Duration) (CleanStats, error) {
+	var stats CleanStats
+	entries, err := c.entries()
+	if err != nil {
+		return stats, err
+	}
+	for _, e := range entries {
+		stats.Entries++
+		stats.Bytes += e.size
+	}
+	evict := func(e *entryInfo) {
+		if !e.complete || !c.purgeUnlessLocked(e.key) {
+			return
+		}
+		e.complete = false
+		stats.Entries--
+		stats.Bytes -= e.size
+		stats.Evicted++
+		stats.EvictedBytes += e.size
+	}
+
+	for _, e := range entries {
+		if !e.complete && c.purgeIfAbandoned(e.key) {
+			stats.Entries--
+			stats.Bytes -= e.size
+			stats.Abandoned++
+		}
+	}
+	if !locksSupported {
+		return stats, nil
+	}
+	if maxAge > 0 {
+		for _, e := range entries {
+			if time.Since(e.created) > maxAge {
+				evict(e)
+			}
+		}
+	}
+	if maxBytes > 0 && stats.Bytes > maxBytes {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].lastUsed.Before(entries[j].lastUsed) })
+		for _, e := range entries {
+			if stats.Bytes <= maxBytes {
+				break
+			}
+			evict(e)
+		}
+	}
+	return stats, nil
+}
+
+// entries lists the entries of the cache. An entry was last used when it was
+// last served, i.e. when its served log was last written, or when it was
+// completed if it was never served.
+func (c *Cache) entries() ([]*entryInfo, error) {
+	dirs, err := filepath.Glob(filepath.Join(c.Dir, "??", "*"))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*entryInfo, 0, len(dirs))
+	for _, dir := range dirs {
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		e := &entryInfo{key: filepath.Base(filepath.Dir(dir)) + filepath.Base(dir)}
+		for _, f := range files {
+			fi, err := f.Info()
+			if err != nil {
+				continue
+			}
+			e.size += fi.Size()
+			switch f.Name() {
+			case "start":
+				e.created = fi.ModTime()
+			case "end":
+				e.complete = true
+				if fi.ModTime().After(e.lastUsed) {
+					e.lastUsed = fi.ModTime()
+				}
+			case "served":
+				if fi.ModTime().After(e.lastUsed) {
+					e.lastUsed = fi.ModTime()
+				}
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
@@ -0,0 +1,156 @@
+package packobjects
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+// writeEntry writes a complete entry of size bytes, last used at lastUsed.
+func writeEntry(t *testing.T, c *Cache, stdin string, size int, lastUsed time.Time) string {
+	t.Helper()
+	key := key([]string{"pack-objects"}, []byte(stdin))
+	e := c.create(key, 0)
+	if e == nil {
+		t.Fatal("cannot create the entry")
+	}
+	if _, err := e.stdout.Write(make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	e.finish(true)
+	for _, file := range []string{"start", "end"} {
+		if err := os.Chtimes(c.path(key, file), lastUsed, lastUsed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return key
+}
+
+func TestClean_EvictsLeastRecentlyServed(t *testing.T) {
+	c := &Cache{Dir: t.TempDir()}
+	now := time.Now()
+	oldest := writeEntry(t, c, "a", 1000, now.Add(-3*time.Hour))
+	served := writeEntry(t, c, "b", 1000, now.Add(-2*time.Hour))
+	newest := writeEntry(t, c, "c", 1000, now.Add(-time.Hour))
+	// Serving the entry makes it the most recently used.
+	c.recordServed(served, "test", 0)
+
+	stats, err := c.Clean(2500, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Evicted != 1 || stats.Entries != 2 {
+		t.Errorf("got %+v, want 1 eviction and 2 entries left", stats)
+	}
+	if fileExists(c.path(oldest)) {
+		t.Error("the least recently used entry was not evicted")
+	}
+	if !fileExists(c.path(served)) || !fileExists(c.path(newest)) {
+		t.Error("a recently used entry was evicted")
+	}
+}
+
+func TestClean_MaxAge(t *testing.T) {
+	c := &Cache{Dir: t.TempDir()}
+	old := writeEntry(t, c, "a", 10, time.Now().Add(-2*time.Hour))
+	recent := writeEntry(t, c, "b", 10, time.Now())
+
+	if _, err := c.Clean(0, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if fileExists(c.path(old)) || !fileExists(c.path(recent)) {
+		t.Error("got the wrong entries evicted, want only the old one")
+	}
+}
+
+func TestClean_KeepsEntriesInUse(t *testing.T) {
+	c := &Cache{Dir: t.TempDir()}
+	old := time.Now().Add(-2 * time.Hour)
+
+	// An entry being written.
+	writing := key([]string{"pack-objects"}, []byte("writing"))
+	e := c.create(writing, 0)
+	if e == nil {
+		t.Fatal("cannot create the entry")
+	}
+	defer e.finish(true)
+	os.Chtimes(c.path(writing, "start"), old, old)
+
+	// An entry being read.
+	reading := writeEntry(t, c, "reading", 10, old)
+	f, err := os.Open(c.path(reading, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := lockShared(f); err != nil {
+		t.Fatal(err)
+	}
+	defer unlock(f)
+
+	stats, err := c.Clean(1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Evicted != 0 || !fileExists(c.path(writing, "start")) || !fileExists(c.path(reading, "end")) {
+		t.Errorf("got %+v, want the entries in use kept", stats)
+	}
+}
+
+func TestClean_PurgesAbandonedEntries(t *testing.T) {
+	c := &Cache{Dir: t.TempDir(), StaleTimeout: time.Hour}
+
+	// An entry whose writer timed out, in the format of the start files
+	// without owner.
+	timedOut := key([]string{"pack-objects"}, []byte("timed out"))
+	os.MkdirAll(c.path(timedOut), 0750)
+	os.WriteFile(c.path(timedOut, "start"), []byte(time.Now().Add(-2*time.Hour).Format(time.RFC3339)+"\n"), 0644)
+	os.WriteFile(c.path(timedOut, "stdout"), []byte("partial"), 0600)
+
+	// An entry whose writer died.
+	dead := key([]string{"pack-objects"}, []byte("dead"))
+	os.MkdirAll(c.path(dead), 0750)
+	o := currentOwner()
+	o.PID = deadPID(t)
+	bs, _ := json.Marshal(o)
+	os.WriteFile(c.path(dead, "start"), bs, 0644)
+
+	// An entry being written.
+	writing := key([]string{"pack-objects"}, []byte("writing"))
+	e := c.create(writing, 0)
+	if e == nil {
+		t.Fatal("cannot create the entry")
+	}
+	defer e.finish(true)
+
+	stats, err := c.Clean(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Abandoned != 2 || fileExists(c.path(timedOut)) || fileExists(c.path(dead)) {
+		t.Errorf("got %+v, want the 2 abandoned entries purged", stats)
+	}
+	if !fileExists(c.path(writing, "start")) {
+		t.Error("the entry being written was purged")
+	}
+}
+
+func TestTakeOutcomes(t *testing.T) {
+	c := &Cache{Dir: t.TempDir(), MaxStdinBytes: 4}
+	args, _ := countingCommand(t)
+	run(t, c, args, "x")
+	run(t, c, args, "x")
+	run(t, c, args, "too long")
+
+	outcomes, err := c.TakeOutcomes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Outcomes{Hits: 1, Misses: 1, Fallbacks: 1}); outcomes != want {
+		t.Errorf("got %+v, want %+v", outcomes, want)
+	}
+	if outcomes, err := c.TakeOutcomes(); err != nil || outcomes != (Outcomes{}) {
+		t.Errorf("got %+v, %v after taking the outcomes, want none", outcomes, err)
+	}
+}
@@ -0,0 +1,32 @@
+//go:build !unix || aix
+
+package packobjects
+
+import "os"
+
+// The locks are no-ops on the other platforms, e.g. Windows, where the files
+// opened by a reader or a writer cannot be deleted anyway. The complete
+// entries are not evicted there.
+const locksSupported = false
+
+func lockShared(f *os.File) error {
+	return nil
+}
+
+func tryLockExclusive(f *os.File) (bool, error) {
+	return true, nil
+}
+
+func tryLockShared(f *os.File) (bool, error) {
+	return true, nil
+}
+
+func unlock(f *os.File) error {
+	return nil
+}
+
+// processAlive cannot tell, so the abandoned entries are only detected by
+// their age.
+func processAlive(pid int) bool {
+	return true
+}
@@ -0,0 +1,48 @@
+//go:build unix && !aix
+
+package packobjects
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// locksSupported is whether the locks below are actually taken.
+const locksSupported = true
+
+// lockShared blocks until it takes a shared lock on f.
+func lockShared(f *os.File) error {
+	return unix.Flock(int(f.Fd()), unix.LOCK_SH)
+}
+
+// tryLockExclusive takes an exclusive lock on f, and returns false if another
+// process holds a lock on it.
+func tryLockExclusive(f *os.File) (bool, error) {
+	err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// tryLockShared takes a shared lock on f, and returns false if another process
+// holds an exclusive lock on it.
+func tryLockShared(f *os.File) (bool, error) {
+	err := unix.Flock(int(f.Fd()), unix.LOCK_SH|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlock(f *os.File) error {
+	return unix.Flock(int(f.Fd()), unix.LOCK_UN)
+}
+
+// processAlive returns whether the process pid of this host is running.
+func processAlive(pid int) bool {
+	err := unix.Kill(pid, 0)
+	return err == nil || errors.Is(err, unix.EPERM)
+}
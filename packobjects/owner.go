@@ -0,0 +1,78 @@
+package packobjects
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultStaleTimeout is how long an entry can be written for, before it is
+// considered abandoned by its writer.
+const DefaultStaleTimeout = 2 * time.Hour
+
+// owner identifies the process writing an entry. It is the content of the
+// start file.
+type owner struct {
+	PID  int       `json:"pid"`
+	Host string    `json:"host"`
+	Time time.Time `json:"time"`
+}
+
+func currentOwner() owner {
+	host, _ := os.Hostname()
+	return owner{PID: os.Getpid(), Host: host, Time: time.Now()}
+}
+
+// readOwner reads a start file. The start files written before the owners
+// were recorded only hold the start time.
+func readOwner(path string) (owner, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return owner{}, err
+	}
+	var o owner
+	if json.Unmarshal(bs, &o) == nil && !o.Time.IsZero() {
+		return o, nil
+	}
+	if t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(bs))); err == nil {
+		return owner{Time: t}, nil
+	}
+	// The writer may have died before writing the file.
+	fi, err := os.Stat(path)
+	if err != nil {
+		return owner{}, err
+	}
+	return owner{Time: fi.ModTime()}, nil
+}
+
+func (c *Cache) staleTimeout() time.Duration {
+	if c.StaleTimeout == 0 {
+		return DefaultStaleTimeout
+	}
+	return c.StaleTimeout
+}
+
+// abandoned returns whether the entry of key is incomplete and its writer is
+// gone: it is a dead process of this host, or it started more than
+// StaleTimeout ago.
+func (c *Cache) abandoned(key string) bool {
+	if fileExists(c.path(key, "end")) {
+		return false
+	}
+	o, err := readOwner(c.path(key, "start"))
+	if err != nil {
+		return false
+	}
+	if time.Since(o.Time) > c.staleTimeout() {
+		return true
+	}
+	host, _ := os.Hostname()
+	return o.PID != 0 && o.Host == host && !processAlive(o.PID)
+}
+
+// purgeIfAbandoned purges the entry of key if it is abandoned, and still
+// not locked by a writer.
+func (c *Cache) purgeIfAbandoned(key string) bool {
+	return c.abandoned(key) && c.purgeUnlessLocked(key)
+}
@@ -0,0 +1,34 @@
+package goblet
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type clientTokenKey struct{}
+
+// clientTokenFromRequest returns the credential of the request's
+// Authorization header as a token that can be replayed upstream.
+func clientTokenFromRequest(r *http.Request) (*oauth2.Token, error) {
+	scheme, credential, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || credential == "" {
+		return nil, status.Error(codes.Unauthenticated, "request not authenticated")
+	}
+	return &oauth2.Token{TokenType: scheme, AccessToken: strings.TrimSpace(credential)}, nil
+}
+
+func withClientToken(ctx context.Context, t *oauth2.Token) context.Context {
+	return context.WithValue(ctx, clientTokenKey{}, t)
+}
+
+// clientToken returns the credential of the client the upstream call is made
+// for, if ServerConfig.CredentialPassthrough is set.
+func clientToken(ctx context.Context) (*oauth2.Token, bool) {
+	t, ok := ctx.Value(clientTokenKey{}).(*oauth2.Token)
+	return t, ok
+}
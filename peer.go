@@ -0,0 +1,174 @@
+package goblet
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PeerBundlePath is the path under which a Goblet server exposes bundles of
+// its managed repositories to sibling replicas.
+const PeerBundlePath = "/peer/bundle"
+
+// A peer download fails once the peer sent nothing for peerIdleTimeout, so
+// that a hung peer doesn't block the startup. Creating the bundle of a large
+// repository can take minutes before its pack is written.
+const peerIdleTimeout = 5 * time.Minute
+
+var peerClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// PeerBundleHandler returns a handler that streams a Git bundle of a managed
+// repository to a peer replica. The repository is selected with the "repo"
+// query parameter. Only repositories that this replica has already fetched
+// from the upstream are served, so that a replica that is still warming up
+// never hands out an empty or partial cache. The handler doesn't authorize
+// requests: it must only be reachable by the peers, e.g. on the admin
+// listener of goblet-server.
+func PeerBundleHandler(config *ServerConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rawURL := r.URL.Query().Get("repo")
+		if rawURL == "" {
+			http.Error(w, "missing repo parameter", http.StatusBadRequest)
+			return
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			http.Error(w, "malformed repo parameter", http.StatusBadRequest)
+			return
+		}
+		u, err = config.URLCanonicalizer(u)
+		if err != nil {
+			http.Error(w, "malformed repo parameter", http.StatusBadRequest)
+			return
+		}
+
+		m, ok := managedRepos.Load(filepath.Join(config.LocalDiskCacheRoot, u.Host, u.Path))
+		if !ok {
+			http.Error(w, "repository is not managed by this replica", http.StatusNotFound)
+			return
+		}
+		repo := m.(*managedRepository)
+		if repo.LastUpdateTime().Unix() == 0 {
+			http.Error(w, "repository has not been fetched by this replica yet", http.StatusServiceUnavailable)
+			return
+		}
+
+		repo.logger().Info("Serving a peer bundle", "peer", r.RemoteAddr)
+		w.Header().Set("Content-Type", "application/x-git-bundle")
+		if err := repo.WriteBundle(w); err != nil {
+			// The headers are already sent. Failing the write is the only
+			// way to let the peer know that the bundle is truncated.
+			repo.logger().Error("Peer bundle failed", "peer", r.RemoteAddr, "err", err)
+			panic(http.ErrAbortHandler)
+		}
+	})
+}
+
+// WarmStartFromPeers bootstraps an empty managed repository from the first
+// peer replica that can serve a bundle of it. Repositories that already have
+// refs on local disk are left untouched. Callers are expected to run a regular
+// upstream fetch afterwards to catch up with the changes made since the peer's
+// last fetch.
+func WarmStartFromPeers(config *ServerConfig, u *url.URL, peers []string) error {
+	repo, err := openManagedRepository(config, u)
+	if err != nil {
+		return err
+	}
+
+	if empty, err := repo.isEmpty(); err != nil {
+		return err
+	} else if !empty {
+		repo.logger().Debug("Peer warm start skipped since the repository is not empty")
+		return nil
+	}
+
+	var lastErr error
+	for _, peer := range peers {
+		if lastErr = repo.recoverFromPeer(peer); lastErr == nil {
+			return nil
+		}
+		repo.logger().Warn("Peer warm start failed", "peer", peer, "err", lastErr)
+	}
+	if lastErr == nil {
+		return fmt.Errorf("no peers configured for %s", repo.upstreamURL)
+	}
+	return fmt.Errorf("cannot warm start %s from any peer: %v", repo.upstreamURL, lastErr)
+}
+
+func (r *managedRepository) recoverFromPeer(peer string) error {
+	bundleURL := strings.TrimSuffix(peer, "/") + PeerBundlePath + "?repo=" + url.QueryEscape(r.upstreamURL.String())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	idleTimer := time.AfterFunc(peerIdleTimeout, cancel)
+	defer idleTimer.Stop()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, bundleURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bs, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("got a non-OK response from the peer: %v %s", resp.StatusCode, strings.TrimSpace(string(bs)))
+	}
+
+	f, err := os.CreateTemp(r.config.LocalDiskCacheRoot, "peer-bundle-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	n, err := io.Copy(f, &idleTimeoutReader{r: resp.Body, timer: idleTimer, timeout: peerIdleTimeout})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot download the bundle: %v", err)
+	}
+	r.logger().Debug("Downloaded a peer bundle", "peer", peer, "bytes", n)
+
+	if err := r.RecoverFromBundle(f.Name()); err != nil {
+		return err
+	}
+	r.logger().Info("Peer warm start succeeded", "peer", peer)
+	return nil
+}
+
+// idleTimeoutReader pushes back timer by timeout on every read.
+type idleTimeoutReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.timer.Reset(r.timeout)
+	return n, err
+}
+
+func (r *managedRepository) isEmpty() (bool, error) {
+	var refs strings.Builder
+	if err := r.runGitWithStdOut(noopOperation{}, &refs, "for-each-ref", "--count=1"); err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(refs.String()) == "", nil
+}
@@ -0,0 +1,116 @@
+package goblet
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ReadinessConfig sets the thresholds under which ReadinessHandler reports
+// that the replica isn't ready to serve.
+type ReadinessConfig struct {
+	// Repositories are the repositories that must be fresh, e.g. the
+	// pre-fetched ones.
+	Repositories []*url.URL
+
+	// MaxStaleness is how long ago the repositories may have last been
+	// updated from the upstream. Zero disables the check.
+	MaxStaleness time.Duration
+
+	// MinFreeDiskBytes is the space that must be free on the filesystem of
+	// the cache root. Zero disables the check.
+	MinFreeDiskBytes uint64
+}
+
+type readinessCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type readinessReport struct {
+	Ready  bool             `json:"ready"`
+	Checks []readinessCheck `json:"checks"`
+}
+
+// ReadinessHandler reports whether the replica can serve fresh data: its
+// repositories were recently updated, upstream tokens can be minted and the
+// disk isn't full. It answers 200 when all the checks pass and 503 otherwise,
+// with the result of each check as JSON.
+func ReadinessHandler(config *ServerConfig, readiness *ReadinessConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := checkReadiness(config, readiness)
+		w.Header().Set("Content-Type", "application/json")
+		if !report.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
+
+func checkReadiness(config *ServerConfig, readiness *ReadinessConfig) *readinessReport {
+	report := &readinessReport{Ready: true}
+	add := func(check readinessCheck) {
+		report.Checks = append(report.Checks, check)
+		report.Ready = report.Ready && check.OK
+	}
+
+	for _, u := range readiness.Repositories {
+		check := readinessCheck{Name: "repository " + u.String()}
+		repo, err := openManagedRepository(config, u)
+		if err != nil {
+			check.Detail = err.Error()
+		} else if lastUpdate := repo.LastUpdateTime(); lastUpdate.Unix() == 0 {
+			check.OK = readiness.MaxStaleness == 0
+			check.Detail = "never updated"
+		} else {
+			staleness := time.Since(lastUpdate).Truncate(time.Second)
+			check.OK = readiness.MaxStaleness == 0 || staleness <= readiness.MaxStaleness
+			check.Detail = fmt.Sprintf("updated %s ago", staleness)
+		}
+		add(check)
+	}
+
+	if config.TokenSource != nil {
+		check := readinessCheck{Name: "token source", OK: true}
+		if err := checkTokenSource(config, readiness.Repositories); err != nil {
+			check.OK = false
+			check.Detail = err.Error()
+		}
+		add(check)
+	}
+
+	if readiness.MinFreeDiskBytes > 0 {
+		check := readinessCheck{Name: "disk"}
+		if free, err := diskFreeBytes(config.LocalDiskCacheRoot); err != nil {
+			check.Detail = err.Error()
+		} else {
+			check.OK = free >= readiness.MinFreeDiskBytes
+			check.Detail = fmt.Sprintf("%d MiB free", free>>20)
+		}
+		add(check)
+	}
+	return report
+}
+
+// checkTokenSource mints the tokens of the repositories, which are cached by
+// the token sources between two expiries.
+func checkTokenSource(config *ServerConfig, repositories []*url.URL) error {
+	ts, ok := config.TokenSource.(URLTokenSource)
+	if !ok || len(repositories) == 0 {
+		_, err := config.TokenSource.Token()
+		return err
+	}
+	for _, u := range repositories {
+		canonical, err := config.URLCanonicalizer(u)
+		if err != nil {
+			return err
+		}
+		if _, err := ts.TokenForURL(canonical); err != nil {
+			return fmt.Errorf("%s: %v", canonical, err)
+		}
+	}
+	return nil
+}
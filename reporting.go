@@ -17,12 +17,14 @@ package goblet
 import (
 	"context"
 	"io"
-	"log"
 	"net/http"
 	"time"
 
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -55,6 +57,7 @@ func (h *httpErrorReporter) reportError(err error) {
 		[]tag.Mutator{tag.Insert(CommandCanonicalStatusKey, code.String())},
 		InboundCommandCount.M(1),
 	)
+	recordSpanError(h.req.Context(), code, err)
 
 	if code == codes.Unauthenticated {
 		h.w.Header().Add("WWW-Authenticate", "Bearer")
@@ -74,7 +77,7 @@ func (h *httpErrorReporter) reportError(err error) {
 		h.config.ErrorReporter(h.req, err)
 		return
 	}
-	log.Printf("Error while processing a request: %v", err)
+	Logger(LogServer).Error("Error while processing a request", "path", h.req.URL.Path, "principal", PrincipalFromContext(h.req.Context()), "err", err)
 }
 
 type gitProtocolHTTPErrorReporter struct {
@@ -94,6 +97,10 @@ func (h *gitProtocolHTTPErrorReporter) reportError(ctx context.Context, startTim
 		InboundCommandCount.M(1),
 		InboundCommandProcessingTime.M(int64(time.Now().Sub(startTime)/time.Millisecond)),
 	)
+	recordSpanError(ctx, code, err)
+	if cacheState, ok := tag.FromContext(ctx).Value(CommandCacheStateKey); ok {
+		updateRequestState(ctx, func(s *requestState) { s.cacheState = cacheState })
+	}
 
 	if err != nil {
 		writeError(h.w, err)
@@ -107,7 +114,21 @@ func (h *gitProtocolHTTPErrorReporter) reportError(ctx context.Context, startTim
 		h.config.ErrorReporter(h.req.WithContext(ctx), err)
 		return
 	}
-	log.Printf("Error while processing a request: %v", err)
+	command, _ := tag.FromContext(ctx).Value(CommandTypeKey)
+	Logger(LogServer).Error("Error while processing a request", "path", h.req.URL.Path, "command", command, "principal", PrincipalFromContext(ctx), "err", err)
+}
+
+// recordSpanError records err on the current span. Only server errors mark the
+// span as failed, the client errors being part of the normal operation.
+func recordSpanError(ctx context.Context, code codes.Code, err error) {
+	if err == nil {
+		return
+	}
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(err)
+	if serverErrorCodes[code] {
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
 }
 
 func logHTTPRequest(config *ServerConfig, w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
@@ -123,6 +144,7 @@ func logHTTPRequest(config *ServerConfig, w http.ResponseWriter, r *http.Request
 	}
 
 	return monW, func() {
+		trace.SpanFromContext(r.Context()).SetAttributes(semconv.HTTPStatusCodeKey.Int(monW.status))
 		if config.RequestLogger == nil {
 			return
 		}
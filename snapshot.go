@@ -0,0 +1,210 @@
+package goblet
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const snapshotManifestName = "manifest.json"
+
+// snapshotManifest is the first entry of a snapshot archive. It describes the
+// bundles that follow it, in the same order.
+type snapshotManifest struct {
+	CreatedAt    time.Time            `json:"created_at"`
+	Repositories []snapshotRepository `json:"repositories"`
+}
+
+type snapshotRepository struct {
+	UpstreamURL    string    `json:"upstream_url"`
+	LastUpdateTime time.Time `json:"last_update_time"`
+	Bundle         string    `json:"bundle"`
+}
+
+// ExportSnapshot writes a portable snapshot of the given managed repositories
+// to w. The snapshot is a gzipped tar archive holding a manifest followed by
+// one bundle per repository. Only repositories that already exist under
+// LocalDiskCacheRoot can be exported.
+func ExportSnapshot(config *ServerConfig, w io.Writer, urls []*url.URL) error {
+	repos := make([]*managedRepository, 0, len(urls))
+	manifest := snapshotManifest{CreatedAt: time.Now().UTC()}
+	for i, u := range urls {
+		cu, err := config.URLCanonicalizer(u)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(filepath.Join(config.LocalDiskCacheRoot, cu.Host, cu.Path)); err != nil {
+			return fmt.Errorf("cannot export %s: %v", cu, err)
+		}
+
+		repo, err := openManagedRepository(config, u)
+		if err != nil {
+			return err
+		}
+		repos = append(repos, repo)
+		manifest.Repositories = append(manifest.Repositories, snapshotRepository{
+			UpstreamURL:    repo.upstreamURL.String(),
+			LastUpdateTime: repo.lastKnownUpdateTime().UTC(),
+			Bundle:         fmt.Sprintf("bundles/%d.bundle", i),
+		})
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	bs, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: snapshotManifestName, Mode: 0644, Size: int64(len(bs)), ModTime: manifest.CreatedAt}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(bs); err != nil {
+		return err
+	}
+
+	for i, repo := range repos {
+		if err := repo.writeSnapshotBundle(tw, manifest.Repositories[i].Bundle); err != nil {
+			return fmt.Errorf("cannot export %s: %v", repo.upstreamURL, err)
+		}
+		repo.logger().Info("Exported the repository to the snapshot")
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// ImportSnapshot restores the repositories of a snapshot written by
+// ExportSnapshot into LocalDiskCacheRoot. Refs of repositories that already
+// exist are overwritten by the ones in the snapshot; a regular upstream fetch
+// is expected afterwards.
+func ImportSnapshot(config *ServerConfig, r io.Reader) ([]ManagedRepository, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the snapshot manifest: %v", err)
+	}
+	if hdr.Name != snapshotManifestName {
+		return nil, fmt.Errorf("not a snapshot archive: got %s, want %s first", hdr.Name, snapshotManifestName)
+	}
+	manifest := snapshotManifest{}
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("cannot parse the snapshot manifest: %v", err)
+	}
+
+	imported := []ManagedRepository{}
+	for _, entry := range manifest.Repositories {
+		hdr, err := tr.Next()
+		if err != nil {
+			return imported, fmt.Errorf("cannot read the bundle of %s: %v", entry.UpstreamURL, err)
+		}
+		if hdr.Name != entry.Bundle {
+			return imported, fmt.Errorf("unexpected snapshot entry: got %s, want %s", hdr.Name, entry.Bundle)
+		}
+
+		u, err := url.Parse(entry.UpstreamURL)
+		if err != nil {
+			return imported, err
+		}
+		m, err := openManagedRepository(config, u)
+		if err != nil {
+			return imported, err
+		}
+		if err := importSnapshotBundle(config, m, tr); err != nil {
+			return imported, fmt.Errorf("cannot import %s: %v", entry.UpstreamURL, err)
+		}
+		if !entry.LastUpdateTime.IsZero() {
+			m.setLastUpdateTime(entry.LastUpdateTime)
+		}
+		m.logger().Info("Imported a repository from the snapshot", "last_update", entry.LastUpdateTime)
+		imported = append(imported, m)
+	}
+	return imported, nil
+}
+
+// writeSnapshotBundle spools the bundle to a temporary file first, since a
+// tar header needs the size of the entry upfront.
+func (r *managedRepository) writeSnapshotBundle(tw *tar.Writer, name string) error {
+	f, err := os.CreateTemp(r.config.LocalDiskCacheRoot, "snapshot-bundle-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := r.WriteBundle(f); err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: fi.Size(), ModTime: fi.ModTime()}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+func importSnapshotBundle(config *ServerConfig, m ManagedRepository, r io.Reader) error {
+	f, err := os.CreateTemp(config.LocalDiskCacheRoot, "snapshot-bundle-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return m.RecoverFromBundle(f.Name())
+}
+
+// lastKnownUpdateTime returns LastUpdateTime, or, if the repository hasn't
+// been fetched by this process, the last time a ref was written on disk.
+func (r *managedRepository) lastKnownUpdateTime() time.Time {
+	if t := r.LastUpdateTime(); t.Unix() != 0 {
+		return t
+	}
+
+	var latest time.Time
+	record := func(fi fs.FileInfo) {
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(r.localDiskPath, "packed-refs")); err == nil {
+		record(fi)
+	}
+	filepath.WalkDir(filepath.Join(r.localDiskPath, "refs"), func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if fi, err := d.Info(); err == nil {
+				record(fi)
+			}
+		}
+		return nil
+	})
+	return latest
+}
@@ -0,0 +1,236 @@
+package goblet
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Number of upstream fetch errors kept for the status page.
+const maxRecentFetchErrors = 20
+
+type fetchError struct {
+	Repository string
+	Time       time.Time
+	Err        string
+}
+
+// fetchErrorLog keeps the most recent upstream fetch errors, oldest first.
+type fetchErrorLog struct {
+	mu     sync.Mutex
+	errors []fetchError
+}
+
+var recentFetchErrors fetchErrorLog
+
+func (l *fetchErrorLog) add(repository string, t time.Time, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errors = append(l.errors, fetchError{Repository: repository, Time: t, Err: err.Error()})
+	if len(l.errors) > maxRecentFetchErrors {
+		l.errors = l.errors[len(l.errors)-maxRecentFetchErrors:]
+	}
+}
+
+func (l *fetchErrorLog) list() []fetchError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]fetchError(nil), l.errors...)
+}
+
+type repositoryStatus struct {
+	UpstreamURL       string
+	Updated           bool
+	LastUpdate        time.Time
+	Staleness         time.Duration
+	SizeBytes         int64
+	QueuedFetches     uint64
+	QueuedUploadPacks uint64
+	UploadPacks       int32
+}
+
+type packObjectsCacheStatus struct {
+	Entries int
+	Hits    int
+}
+
+func (s packObjectsCacheStatus) HitRate() float64 {
+	if s.Entries+s.Hits == 0 {
+		return 0
+	}
+	// Every entry was a miss when it was created.
+	return float64(s.Hits) / float64(s.Entries+s.Hits)
+}
+
+type authCacheStatus struct {
+	AuthDecisionCacheMetrics
+	Keys      int
+	Evictions int64
+}
+
+type statusPage struct {
+	Time             time.Time
+	Repositories     []repositoryStatus
+	FetchErrors      []fetchError
+	PackObjectsCache *packObjectsCacheStatus
+	AuthCache        *authCacheStatus
+}
+
+// StatusHandler renders an HTML page of what the server is doing: the managed
+// repositories with their freshness, size and queues, the recent upstream
+// fetch errors, and the hit rates of the pack-objects cache and of authCache,
+// if not nil. The sizes are computed on every request by walking the cache,
+// so the page is meant for operators rather than for probes.
+func StatusHandler(config *ServerConfig, authCache *AuthDecisionCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := &statusPage{Time: time.Now(), FetchErrors: recentFetchErrors.list()}
+		managedRepos.Range(func(_, v any) bool {
+			repo := v.(*managedRepository)
+			st := repositoryStatus{
+				UpstreamURL:       repo.upstreamURL.String(),
+				LastUpdate:        repo.LastUpdateTime(),
+				SizeBytes:         diskUsage(repo.localDiskPath),
+				QueuedFetches:     repo.fetchUpstreamPool.WaitingTasks(),
+				QueuedUploadPacks: repo.serveFetchPool.WaitingTasks(),
+				UploadPacks:       atomic.LoadInt32(&repo.uploadPacks),
+			}
+			if st.LastUpdate.Unix() != 0 {
+				st.Updated = true
+				st.Staleness = page.Time.Sub(st.LastUpdate).Truncate(time.Second)
+			}
+			page.Repositories = append(page.Repositories, st)
+			return true
+		})
+		sort.Slice(page.Repositories, func(i, j int) bool {
+			return page.Repositories[i].UpstreamURL < page.Repositories[j].UpstreamURL
+		})
+		if config.PackObjectsCache != "" {
+			st := scanPackObjectsCache(config.PackObjectsCache)
+			page.PackObjectsCache = &st
+		}
+		if authCache != nil {
+			st := &authCacheStatus{AuthDecisionCacheMetrics: authCache.Metrics(), Keys: -1}
+			// Shared stores may not know their size.
+			if store, ok := authCache.Store.(*MemoryAuthCache); ok {
+				st.Keys = store.Len()
+				st.Evictions = store.Evictions()
+			}
+			page.AuthCache = st
+		}
+
+		var buf bytes.Buffer
+		if err := statusTemplate.Execute(&buf, page); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(buf.Bytes())
+	})
+}
+
+// diskUsage returns the size of the files under dir.
+func diskUsage(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if fi, err := d.Info(); err == nil {
+				size += fi.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// scanPackObjectsCache counts the entries of the pack-objects hook cache, and
+// the times they were served successfully, i.e. the lines of their "served"
+// files ending with the exit code 0.
+func scanPackObjectsCache(dir string) packObjectsCacheStatus {
+	var st packObjectsCacheStatus
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		switch d.Name() {
+		case "start":
+			st.Entries++
+		case "served":
+			if f, err := os.Open(path); err == nil {
+				scanner := bufio.NewScanner(f)
+				for scanner.Scan() {
+					// "<time> <CI source> <exit code>"
+					fields := strings.Fields(scanner.Text())
+					if len(fields) > 0 && fields[len(fields)-1] == "0" {
+						st.Hits++
+					}
+				}
+				f.Close()
+			}
+		}
+		return nil
+	})
+	return st
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"mib": func(n int64) string {
+		return fmt.Sprintf("%.1f", float64(n)/(1<<20))
+	},
+	"percent": func(f float64) string {
+		return fmt.Sprintf("%.1f", f*100)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Goblet status</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.5em; text-align: left; }
+</style>
+</head>
+<body>
+<h1>Goblet status</h1>
+<p>As of {{.Time.Format "2006-01-02 15:04:05 MST"}}</p>
+
+<h2>Repositories</h2>
+<table>
+<tr><th>Upstream</th><th>Last update</th><th>Staleness</th><th>Size (MiB)</th><th>Queued fetches</th><th>Queued upload-packs</th><th>Running upload-packs</th></tr>
+{{range .Repositories}}<tr><td>{{.UpstreamURL}}</td><td>{{if .Updated}}{{.LastUpdate.Format "2006-01-02 15:04:05 MST"}}{{else}}never{{end}}</td><td>{{if .Updated}}{{.Staleness}}{{end}}</td><td>{{mib .SizeBytes}}</td><td>{{.QueuedFetches}}</td><td>{{.QueuedUploadPacks}}</td><td>{{.UploadPacks}}</td></tr>
+{{end}}</table>
+
+<h2>Recent fetch errors</h2>
+{{if .FetchErrors}}<table>
+<tr><th>Time</th><th>Upstream</th><th>Error</th></tr>
+{{range .FetchErrors}}<tr><td>{{.Time.Format "2006-01-02 15:04:05 MST"}}</td><td>{{.Repository}}</td><td>{{.Err}}</td></tr>
+{{end}}</table>{{else}}<p>None</p>{{end}}
+
+{{with .PackObjectsCache}}<h2>Pack-objects cache</h2>
+<table>
+<tr><th>Entries</th><td>{{.Entries}}</td></tr>
+<tr><th>Hits</th><td>{{.Hits}}</td></tr>
+<tr><th>Hit rate (%)</th><td>{{percent .HitRate}}</td></tr>
+</table>{{end}}
+
+{{with .AuthCache}}<h2>Authorization cache</h2>
+<table>
+<tr><th>Hits</th><td>{{.Hits}}</td></tr>
+<tr><th>Misses</th><td>{{.Misses}}</td></tr>
+<tr><th>Inserts</th><td>{{.Inserts}}</td></tr>
+<tr><th>Stale hits</th><td>{{.StaleHits}}</td></tr>
+{{if ge .Keys 0}}<tr><th>Keys</th><td>{{.Keys}}</td></tr>
+<tr><th>Evictions</th><td>{{.Evictions}}</td></tr>{{end}}
+</table>{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,86 @@
+package end2end
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/canva/goblet"
+	goblettest "github.com/canva/goblet/testing"
+)
+
+func TestFetch_AccessLog(t *testing.T) {
+	out := &syncBuffer{}
+	logger, err := goblet.NewAccessLogger(out, goblet.AccessLogFormatJSON, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		RequestLogger:     logger,
+	})
+	defer ts.Close()
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "-c", "http.extraHeader=CI-Source: access-log-test", "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	var upstream map[string]any
+	for _, record := range out.records(t) {
+		if record["ci_source"] != "access-log-test" {
+			t.Errorf("got CI source %v, want access-log-test", record["ci_source"])
+		}
+		if record["cache_state"] == "queried-upstream" {
+			upstream = record
+		}
+	}
+	if upstream == nil {
+		t.Fatalf("no request querying the upstream logged: %s", out.buf.String())
+	}
+	if upstream["status"] != float64(200) || upstream["repository"] == nil {
+		t.Errorf("got %v, want a successful request of a repository", upstream)
+	}
+}
+
+func TestAccessLog_SuccessSampling(t *testing.T) {
+	out := &syncBuffer{}
+	logger, err := goblet.NewAccessLogger(out, goblet.AccessLogFormatCombined, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		RequestLogger:     logger,
+	})
+	defer ts.Close()
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer invalid-token", "fetch", ts.ProxyServerURL); err == nil {
+		t.Fatal("fetch with an invalid token succeeded")
+	}
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "ls-remote", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.buf.String()), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], `" 401 `) {
+		t.Errorf("got %q, want only the unauthenticated request", lines)
+	}
+	// The client is not authenticated, so the authuser field is "-".
+	if !strings.Contains(lines[0], " - - [") {
+		t.Errorf("got %q, want no authuser", lines[0])
+	}
+}
+
+func TestNewAccessLogger_UnknownFormat(t *testing.T) {
+	if _, err := goblet.NewAccessLogger(&syncBuffer{}, "xml", 1); err == nil {
+		t.Error("got no error for an unknown format")
+	}
+}
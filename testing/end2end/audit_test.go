@@ -0,0 +1,128 @@
+package end2end
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/canva/goblet"
+	goblettest "github.com/canva/goblet/testing"
+)
+
+func TestFetch_AuditLog(t *testing.T) {
+	var mu sync.Mutex
+	entries := []goblet.AuditEntry{}
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblet.NewStaticTokenRequestAuthorizer([]string{goblettest.ValidClientAuthToken}),
+		TokenSource:       goblettest.TestTokenSource,
+		AuditLogger: func(entry *goblet.AuditEntry) {
+			mu.Lock()
+			defer mu.Unlock()
+			entries = append(entries, *entry)
+		},
+	})
+	defer ts.Close()
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "-c", "http.extraHeader=CI-Source: audit-test", "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var fetch *goblet.AuditEntry
+	for i, entry := range entries {
+		if entry.Command == "fetch" {
+			fetch = &entries[i]
+		}
+		if want := "static:" + goblet.CredentialFingerprint(goblettest.ValidClientAuthToken); entry.Principal != want {
+			t.Errorf("got principal %s, want %s", entry.Principal, want)
+		}
+		if entry.CISource != "audit-test" {
+			t.Errorf("got CI source %s, want audit-test", entry.CISource)
+		}
+		if entry.Status != "OK" {
+			t.Errorf("got status %s for %s, want OK", entry.Status, entry.Command)
+		}
+	}
+	if fetch == nil {
+		t.Fatalf("no fetch audited: %+v", entries)
+	}
+	if fetch.Wants != 1 || fetch.BytesServed == 0 || fetch.CacheState != "queried-upstream" {
+		t.Errorf("got fetch entry %+v, want 1 want, some bytes served and an upstream fetch", *fetch)
+	}
+}
+
+func TestFetch_AuditLogFailedFetch(t *testing.T) {
+	var mu sync.Mutex
+	entries := []goblet.AuditEntry{}
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblet.NewStaticTokenRequestAuthorizer([]string{goblettest.ValidClientAuthToken}),
+		TokenSource:       goblettest.TestTokenSource,
+		AuditLogger: func(entry *goblet.AuditEntry) {
+			mu.Lock()
+			defer mu.Unlock()
+			entries = append(entries, *entry)
+		},
+	})
+	defer ts.Close()
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	missing := strings.Repeat("1", 40)
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL, missing); err == nil {
+		t.Fatal("fetching a missing object succeeded")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, entry := range entries {
+		if entry.Command != "fetch" {
+			continue
+		}
+		if entry.Status != "Unavailable" {
+			t.Errorf("got status %s for a failed fetch, want Unavailable", entry.Status)
+		}
+		return
+	}
+	t.Fatalf("no fetch audited: %+v", entries)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	f, err := goblet.NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for suffix, want := range map[string]string{"": "fourth\n", ".1": "third\n", ".2": "second\n"} {
+		got, err := os.ReadFile(path + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("got %q in %s, want %q", got, path+suffix, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("got %v for the third backup, want it removed", err)
+	}
+}
@@ -0,0 +1,36 @@
+package end2end
+
+import (
+	"testing"
+
+	"github.com/canva/goblet"
+	goblettest "github.com/canva/goblet/testing"
+)
+
+func TestFetch_StaticTokenAuthorizer(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblet.NewStaticTokenRequestAuthorizer([]string{goblettest.ValidClientAuthToken}),
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer invalid-token", "fetch", ts.ProxyServerURL); err == nil {
+		t.Fatal("fetch with an invalid token succeeded")
+	}
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := client.Run("rev-parse", "FETCH_HEAD"); err != nil {
+		t.Error(err)
+	} else if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
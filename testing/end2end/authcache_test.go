@@ -0,0 +1,52 @@
+package end2end
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/canva/goblet"
+)
+
+func TestAuthDecisionCache(t *testing.T) {
+	store := goblet.NewMemoryAuthCache(0)
+	defer store.Close()
+	cache := goblet.NewAuthDecisionCache(store, []byte("hash-key"), time.Hour, time.Hour, time.Hour)
+
+	validations := 0
+	authorize := func(credential string, authorized, cacheable bool, err error) (bool, error) {
+		return cache.Authorize(credential, "https://github.com/canva/goblet", func() (bool, bool, error) {
+			validations++
+			return authorized, cacheable, err
+		})
+	}
+
+	if ok, _ := authorize("good", true, true, nil); !ok {
+		t.Fatal("got unauthorized, want authorized")
+	}
+	if ok, _ := authorize("good", false, true, nil); !ok || validations != 1 {
+		t.Errorf("got authorized:%t after %d validations, want the cached positive decision", ok, validations)
+	}
+	if ok, _ := authorize("bad", false, true, errors.New("denied")); ok {
+		t.Fatal("got authorized, want unauthorized")
+	}
+	if ok, _ := authorize("bad", true, true, nil); ok || validations != 2 {
+		t.Errorf("got authorized:%t after %d validations, want the cached negative decision", ok, validations)
+	}
+
+	// Expire the positive decision. It's still used while the upstream is
+	// unreachable, but not once the upstream denies the credential.
+	cache.PositiveTTL = 0
+	if ok, err := authorize("good", false, false, errors.New("unreachable")); !ok || err != nil {
+		t.Errorf("got authorized:%t, err:%v while unreachable, want the stale positive decision", ok, err)
+	}
+	if ok, _ := authorize("good", false, true, errors.New("denied")); ok {
+		t.Error("got authorized, want the new negative decision")
+	}
+
+	// Unknown credentials aren't authorized while the upstream is
+	// unreachable.
+	if ok, _ := authorize("unknown", false, false, errors.New("unreachable")); ok {
+		t.Error("got authorized, want unauthorized")
+	}
+}
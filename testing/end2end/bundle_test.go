@@ -0,0 +1,160 @@
+package end2end
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/canva/goblet"
+	goblettest "github.com/canva/goblet/testing"
+)
+
+var bundleRepositoryURL = &url.URL{Scheme: "https", Host: "example.com", Path: "/owner/repo"}
+
+// newBundleTestServer returns a test server whose repository was fetched, and
+// the path of its clone bundle once generated.
+func newBundleTestServer(t *testing.T, maxAge time.Duration) (*goblettest.TestServer, string) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		BundleDir:         t.TempDir(),
+		BundleMaxAge:      maxAge,
+	})
+	t.Cleanup(ts.Close)
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := goblet.OpenManagedRepository(ts.ServerConfig, bundleRepositoryURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundlePath := filepath.Join(ts.ServerConfig.BundleDir, repo.UpstreamURL().Host, repo.UpstreamURL().Path+".bundle")
+	fetchUpstream(t, ts)
+	waitForBundle(t, bundlePath, time.Time{})
+	return ts, bundlePath
+}
+
+// fetchUpstream runs a background fetch, which regenerates the bundle when
+// older than BundleMaxAge.
+func fetchUpstream(t *testing.T, ts *goblettest.TestServer) {
+	errorChan := make(chan error, 2)
+	goblet.FetchManagedRepositoryAsync(ts.ServerConfig, bundleRepositoryURL, true, errorChan)
+	if err := <-errorChan; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForBundle waits until the bundle was modified after t.
+func waitForBundle(t *testing.T, bundlePath string, after time.Time) os.FileInfo {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if fi, err := os.Stat(bundlePath); err == nil && fi.ModTime().After(after) {
+			return fi
+		}
+	}
+	t.Fatalf("%s was not generated", bundlePath)
+	return nil
+}
+
+func pktLine(s string) string {
+	return fmt.Sprintf("%04x%s", len(s)+4, s)
+}
+
+func proxyRequest(t *testing.T, method, u, body string, header http.Header) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, u, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = header
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bs, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, bs
+}
+
+func TestBundle_Advertised(t *testing.T) {
+	ts, bundlePath := newBundleTestServer(t, time.Hour)
+	repoURL := ts.ProxyServerURL + strings.TrimPrefix(bundleRepositoryURL.Path, "/")
+	header := http.Header{
+		"Authorization": {"Bearer " + goblettest.ValidClientAuthToken},
+		"Git-Protocol":  {"version=2"},
+	}
+
+	_, body := proxyRequest(t, http.MethodGet, repoURL+"/info/refs?service=git-upload-pack", "", header)
+	if !bytes.Contains(body, []byte("bundle-uri")) {
+		t.Errorf("info/refs doesn't advertise bundle-uri:\n%s", body)
+	}
+
+	_, body = proxyRequest(t, http.MethodPost, repoURL+"/git-upload-pack", pktLine("command=bundle-uri\n")+"0001"+"0000", header)
+	_, uri, ok := strings.Cut(string(body), "bundle.goblet.uri=")
+	if !ok {
+		t.Fatalf("bundle-uri doesn't list the bundle:\n%s", body)
+	}
+	uri, _, _ = strings.Cut(uri, "\n")
+
+	want, err := os.ReadFile(bundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, got := proxyRequest(t, http.MethodGet, uri, "", http.Header{
+		"Authorization": {"Bearer " + goblettest.ValidClientAuthToken},
+		"Range":         {"bytes=4-"},
+	})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Errorf("got status %d, want 206", resp.StatusCode)
+	}
+	if !bytes.Equal(got, want[4:]) {
+		t.Errorf("got %d bytes of the bundle from byte 4, want %d", len(got), len(want)-4)
+	}
+}
+
+func TestBundle_RequiresAuthorization(t *testing.T) {
+	ts, _ := newBundleTestServer(t, time.Hour)
+	repo, err := goblet.OpenManagedRepository(ts.ServerConfig, bundleRepositoryURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uri := ts.ProxyServerURL + strings.TrimPrefix(goblet.BundlePathPrefix, "/") + repo.UpstreamURL().Host + repo.UpstreamURL().Path + ".bundle"
+	resp, _ := proxyRequest(t, http.MethodGet, uri, "", http.Header{})
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestBundle_RegeneratedAfterMaxAge(t *testing.T) {
+	ts, bundlePath := newBundleTestServer(t, time.Hour)
+
+	// A bundle younger than BundleMaxAge is kept.
+	young := time.Now().Add(-time.Minute).Truncate(time.Second)
+	if err := os.Chtimes(bundlePath, young, young); err != nil {
+		t.Fatal(err)
+	}
+	fetchUpstream(t, ts)
+	// The bundle is updated in the background.
+	time.Sleep(200 * time.Millisecond)
+	if fi, err := os.Stat(bundlePath); err != nil {
+		t.Fatal(err)
+	} else if !fi.ModTime().Equal(young) {
+		t.Errorf("the bundle modified at %v was regenerated", young)
+	}
+
+	old := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(bundlePath, old, old); err != nil {
+		t.Fatal(err)
+	}
+	fetchUpstream(t, ts)
+	waitForBundle(t, bundlePath, old)
+}
@@ -0,0 +1,33 @@
+package end2end
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canva/goblet"
+)
+
+func TestCheckGitVersion(t *testing.T) {
+	if _, err := goblet.CheckGitVersion(""); err != nil {
+		t.Fatalf("the git in PATH is not supported: %v", err)
+	}
+
+	for version, wantErr := range map[string]bool{
+		"2.29.0":                 false,
+		"2.39.5 (Apple Git-154)": false,
+		"2.40.0.windows.1":       false,
+		"3.0":                    false,
+		"2.28.1":                 true,
+		"1.99.9":                 true,
+		"unknown":                true,
+	} {
+		gitBinary := filepath.Join(t.TempDir(), "git")
+		if err := os.WriteFile(gitBinary, []byte("#!/bin/sh\necho 'git version "+version+"'\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := goblet.CheckGitVersion(gitBinary); (err != nil) != wantErr {
+			t.Errorf("got %v for git %s, want error: %t", err, version, wantErr)
+		}
+	}
+}
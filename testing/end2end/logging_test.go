@@ -0,0 +1,85 @@
+package end2end
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/canva/goblet"
+	goblettest "github.com/canva/goblet/testing"
+)
+
+// syncBuffer is written by the server goroutines and read by the test.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) records(t *testing.T) []map[string]any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var ret []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		record := map[string]any{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		ret = append(ret, record)
+	}
+	return ret
+}
+
+func TestLogging_SubsystemLevels(t *testing.T) {
+	out := &syncBuffer{}
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	goblet.SetLogLevel(goblet.LogServer, slog.LevelWarn)
+	goblet.SetLogLevel(goblet.LogRepository, slog.LevelDebug)
+	defer goblet.SetLogLevel(goblet.LogServer, slog.LevelInfo)
+	defer goblet.SetLogLevel(goblet.LogRepository, slog.LevelInfo)
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	repositoryRecords := 0
+	for _, record := range out.records(t) {
+		switch record["subsystem"] {
+		case goblet.LogServer:
+			if record["level"] != "WARN" && record["level"] != "ERROR" {
+				t.Errorf("got a server log below the warn level: %v", record)
+			}
+		case goblet.LogRepository:
+			repositoryRecords++
+			if record["repo"] == nil || record["dir"] == nil {
+				t.Errorf("got a repository log without repo and dir: %v", record)
+			}
+		}
+	}
+	if repositoryRecords == 0 {
+		t.Error("got no repository log")
+	}
+}
@@ -0,0 +1,67 @@
+package end2end
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/canva/goblet"
+	goblettest "github.com/canva/goblet/testing"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFetch_PrometheusMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		Metrics:           goblet.NewPrometheusMetrics(registry),
+	})
+	defer ts.Close()
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bool{}
+	for _, f := range families {
+		got[f.GetName()] = true
+	}
+	for _, name := range []string{"goblet_v2request_dist", "goblet_fetchupstream_dist", "goblet_operation_time_seconds", "goblet_operation_concurrency"} {
+		if !got[name] {
+			t.Errorf("metric %s not exported, got %v", name, got)
+		}
+	}
+}
+
+func TestPrometheusMetrics_MissingTags(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := goblet.NewPrometheusMetrics(registry)
+	m.Count("goblet.operation.count", 1, []string{"op:token_validation"})
+	m.Count("goblet.operation.count", 2, []string{"dir:/cache/repo", "op:background_fetch", "must:1"})
+	m.Timing("goblet.custom", 2*time.Second, []string{"kind:test", "untagged"})
+
+	want := `
+# HELP goblet_operation_count goblet.operation.count
+# TYPE goblet_operation_count counter
+goblet_operation_count{dir="",must="",op="token_validation",triggered_by=""} 1
+goblet_operation_count{dir="/cache/repo",must="1",op="background_fetch",triggered_by=""} 2
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want), "goblet_operation_count"); err != nil {
+		t.Error(err)
+	}
+	if n, err := testutil.GatherAndCount(registry, "goblet_custom_seconds"); err != nil || n != 1 {
+		t.Errorf("got %d goblet_custom_seconds series (err:%v), want 1", n, err)
+	}
+}
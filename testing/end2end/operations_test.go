@@ -0,0 +1,77 @@
+package end2end
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/canva/goblet"
+	goblettest "github.com/canva/goblet/testing"
+)
+
+func TestOperationEvents(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+
+	resp, err := http.Get(ts.AdminServerURL + "operations/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Fatalf("got content type %s, want text/event-stream", got)
+	}
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	// The upstream fetch is done by the time the client fetch returns.
+	scanner := bufio.NewScanner(resp.Body)
+	event := ""
+	updates := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			event = name
+			continue
+		}
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var op goblet.Operation
+		if err := json.Unmarshal([]byte(data), &op); err != nil {
+			t.Fatal(err)
+		}
+		if op.Action != "FetchUpstream" || op.Repository != strings.TrimSuffix(ts.UpstreamServerURL, "/") {
+			continue
+		}
+		if event == "update" {
+			updates++
+			continue
+		}
+		if event != "done" || op.Err != "" {
+			t.Errorf("got %s event %+v, want a successful done event", event, op)
+		}
+		break
+	}
+	if updates == 0 {
+		t.Error("got no update event before the fetch ended")
+	}
+
+	for _, op := range goblet.ListOperations() {
+		if op.Repository == strings.TrimSuffix(ts.UpstreamServerURL, "/") {
+			t.Errorf("got in-flight operation %+v after the fetch", op)
+		}
+	}
+}
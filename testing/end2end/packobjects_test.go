@@ -0,0 +1,69 @@
+package end2end
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canva/goblet/packobjects"
+	goblettest "github.com/canva/goblet/testing"
+)
+
+// TestMain lets the test binary run as the pack-objects hook, like
+// goblet-server does.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == packobjects.HookCommand {
+		os.Exit(packobjects.RunHook(os.Args[2:]))
+	}
+	os.Exit(m.Run())
+}
+
+func TestFetch_BuiltinPackObjectsHook(t *testing.T) {
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheDir := t.TempDir()
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		PackObjectsHook:   packobjects.HookCommandLine(executable),
+		PackObjectsCache:  cacheDir,
+	})
+	defer ts.Close()
+
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		client := goblettest.NewLocalGitRepo()
+		defer client.Close()
+		if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := client.Run("rev-parse", "FETCH_HEAD"); err != nil {
+			t.Fatal(err)
+		} else if got != want {
+			t.Errorf("fetch %d: got %s, want %s", i, got, want)
+		}
+	}
+
+	// The second fetch is served from the entry written by the first one.
+	served, err := filepath.Glob(filepath.Join(cacheDir, "??", "*", "served"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(served) != 1 {
+		t.Fatalf("got %d served entries, want 1", len(served))
+	}
+	bs, err := os.ReadFile(served[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(bs), "\n"); lines != 1 {
+		t.Errorf("the entry was served %d times, want 1:\n%s", lines, bs)
+	}
+}
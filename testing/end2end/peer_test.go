@@ -0,0 +1,91 @@
+package end2end
+
+import (
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canva/goblet"
+	goblettest "github.com/canva/goblet/testing"
+)
+
+// peerRepositoryURL is canonicalized to the upstream repository of any test
+// server.
+var peerRepositoryURL = &url.URL{Scheme: "https", Host: "example.com"}
+
+func TestWarmStartFromPeers(t *testing.T) {
+	peer := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer peer.Close()
+	want, err := peer.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", peer.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+	if err := goblet.WarmStartFromPeers(ts.ServerConfig, peerRepositoryURL, []string{peer.AdminServerURL}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The commit only exists upstream of the peer.
+	repo, err := goblet.OpenManagedRepository(ts.ServerConfig, peerRepositoryURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := goblettest.GitRepo(filepath.Join(ts.ServerConfig.LocalDiskCacheRoot, repo.UpstreamURL().Host, repo.UpstreamURL().Path))
+	if got, err := local.Run("rev-parse", "master"); err != nil {
+		t.Fatal(err)
+	} else if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestWarmStartFromPeers_FallsBackToUpstream(t *testing.T) {
+	// The peer never fetched the repository.
+	peer := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer peer.Close()
+	if _, err := goblet.OpenManagedRepository(peer.ServerConfig, peerRepositoryURL); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = goblet.WarmStartFromPeers(ts.ServerConfig, peerRepositoryURL, []string{peer.AdminServerURL})
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("got %v, want an error for the unfetched repository", err)
+	}
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := client.Run("rev-parse", "FETCH_HEAD"); err != nil {
+		t.Error(err)
+	} else if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,86 @@
+package end2end
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/canva/goblet"
+	goblettest "github.com/canva/goblet/testing"
+)
+
+type readinessReport struct {
+	Ready  bool `json:"ready"`
+	Checks []struct {
+		Name   string `json:"name"`
+		OK     bool   `json:"ok"`
+		Detail string `json:"detail"`
+	} `json:"checks"`
+}
+
+func getReadiness(t *testing.T, ts *goblettest.TestServer) (int, readinessReport) {
+	resp, err := http.Get(ts.ProxyServerURL + "readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var report readinessReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, report
+}
+
+func TestReadiness_RepositoryFreshness(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		Readiness: &goblet.ReadinessConfig{
+			Repositories: []*url.URL{{Scheme: "https", Host: "example.com"}},
+			MaxStaleness: time.Hour,
+		},
+	})
+	defer ts.Close()
+
+	if status, report := getReadiness(t, ts); status != http.StatusServiceUnavailable || report.Ready {
+		t.Errorf("got %d %+v before any fetch, want 503", status, report)
+	}
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	status, report := getReadiness(t, ts)
+	if status != http.StatusOK || !report.Ready {
+		t.Errorf("got %d %+v after a fetch, want 200", status, report)
+	}
+	if len(report.Checks) != 2 {
+		t.Errorf("got checks %+v, want the repository and the token source", report.Checks)
+	}
+}
+
+func TestReadiness_DiskFull(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		Readiness:         &goblet.ReadinessConfig{MinFreeDiskBytes: 1 << 62},
+	})
+	defer ts.Close()
+
+	status, report := getReadiness(t, ts)
+	if status != http.StatusServiceUnavailable || report.Ready {
+		t.Errorf("got %d %+v, want 503", status, report)
+	}
+	for _, check := range report.Checks {
+		if check.Name == "disk" && check.OK {
+			t.Errorf("got disk check %+v, want a failure", check)
+		}
+	}
+}
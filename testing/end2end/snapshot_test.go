@@ -0,0 +1,64 @@
+package end2end
+
+import (
+	"bytes"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canva/goblet"
+	goblettest "github.com/canva/goblet/testing"
+)
+
+func TestSnapshot_RoundTrip(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	errorChan := make(chan error, 2)
+	goblet.FetchManagedRepositoryAsync(ts.ServerConfig, bundleRepositoryURL, true, errorChan)
+	if err := <-errorChan; err != nil {
+		t.Fatal(err)
+	}
+	exported, err := goblet.OpenManagedRepository(ts.ServerConfig, bundleRepositoryURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var snapshot bytes.Buffer
+	if err := goblet.ExportSnapshot(ts.ServerConfig, &snapshot, []*url.URL{bundleRepositoryURL}); err != nil {
+		t.Fatal(err)
+	}
+	config := *ts.ServerConfig
+	config.LocalDiskCacheRoot = t.TempDir()
+	if _, err := goblet.ImportSnapshot(&config, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	// The import runs in its own process: the server started afterwards
+	// only finds what was written in the cache root.
+	restarted := *ts.ServerConfig
+	restarted.LocalDiskCacheRoot = t.TempDir()
+	if err := os.CopyFS(restarted.LocalDiskCacheRoot, os.DirFS(config.LocalDiskCacheRoot)); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := goblet.OpenManagedRepository(&restarted, bundleRepositoryURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := repo.LastUpdateTime(), exported.LastUpdateTime(); !got.Equal(want) {
+		t.Errorf("got last update time %v, want %v", got, want)
+	}
+	local := goblettest.GitRepo(filepath.Join(restarted.LocalDiskCacheRoot, repo.UpstreamURL().Host, repo.UpstreamURL().Path))
+	if got, err := local.Run("rev-parse", "master"); err != nil {
+		t.Fatal(err)
+	} else if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
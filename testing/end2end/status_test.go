@@ -0,0 +1,103 @@
+package end2end
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canva/goblet"
+	goblettest "github.com/canva/goblet/testing"
+)
+
+func TestStatusPage(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	store := goblet.NewMemoryAuthCache(0)
+	defer store.Close()
+	handler := goblet.StatusHandler(&goblet.ServerConfig{}, goblet.NewAuthDecisionCache(store, nil, 0, 0, 0))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", w.Code)
+	}
+	body := w.Body.String()
+	for _, want := range []string{strings.TrimSuffix(ts.UpstreamServerURL, "/"), "Authorization cache"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("status page doesn't contain %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "Pack-objects cache") {
+		t.Error("status page shows the pack-objects cache, which is not configured")
+	}
+}
+
+func TestStatusPage_TokenErrors(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       failingTokenSource{},
+	})
+	defer ts.Close()
+
+	errorChan := make(chan error, 2)
+	goblet.FetchManagedRepositoryAsync(ts.ServerConfig, &url.URL{Scheme: "https", Host: "example.com", Path: "/token-error"}, true, errorChan)
+	if err := <-errorChan; err == nil {
+		t.Fatal("fetched without an upstream token")
+	}
+
+	resp, err := http.Get(ts.AdminServerURL + "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want 200", resp.StatusCode)
+	}
+	if !strings.Contains(string(body), "cannot obtain an OAuth2 access token") {
+		t.Errorf("status page doesn't list the token error:\n%s", body)
+	}
+}
+
+func TestStatusPage_PackObjectsCacheHits(t *testing.T) {
+	dir := t.TempDir()
+	entry := filepath.Join(dir, "ab", "cdef")
+	if err := os.MkdirAll(entry, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(entry, "start"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The second serve failed.
+	served := "2026-01-02T03:04:05Z ci 0\n2026-01-02T03:04:06Z ci 1\n"
+	if err := os.WriteFile(filepath.Join(entry, "served"), []byte(served), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	goblet.StatusHandler(&goblet.ServerConfig{PackObjectsCache: dir}, nil).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if want := "<tr><th>Hits</th><td>1</td></tr>"; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("status page doesn't contain %q:\n%s", want, w.Body.String())
+	}
+}
@@ -0,0 +1,195 @@
+package end2end
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/canva/goblet"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCertificate(t *testing.T, subject pkix.Name, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, key.Public(), signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificate{cert: cert, key: key}
+}
+
+func (c *testCertificate) writePEM(t *testing.T, certFile, keyFile string) {
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if keyFile == "" {
+		return
+	}
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func TestClientCertificateRequestAuthorizer(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, pkix.Name{CommonName: "test-ca"}, nil)
+	ca.writePEM(t, filepath.Join(dir, "ca.pem"), "")
+	server := newTestCertificate(t, pkix.Name{CommonName: "goblet"}, ca)
+	server.writePEM(t, filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"))
+
+	reloader, err := goblet.NewCertificateReloader(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := goblet.NewServerTLSConfig(reloader, filepath.Join(dir, "ca.pem"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authorizer := goblet.NewClientCertificateRequestAuthorizer(
+		[]goblet.ClientCertificateRule{{Subject: "CN=ci-*,O=Canva", Repositories: []string{"github.com/canva/*"}}},
+		func(u *url.URL) (*url.URL, error) {
+			return &url.URL{Scheme: "https", Host: "github.com", Path: strings.TrimSuffix(u.Path, "/info/refs")}, nil
+		},
+		func(*http.Request) error { return status.Error(codes.Unauthenticated, "request not authenticated") },
+	)
+	// Not StartTLS, which would serve its own certificate.
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := authorizer(r); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+		}
+	}))
+	srv.Listener = tls.NewListener(srv.Listener, tlsConfig)
+	srv.Start()
+	defer srv.Close()
+	srvURL := strings.Replace(srv.URL, "http://", "https://", 1)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	ci := newTestCertificate(t, pkix.Name{CommonName: "ci-runner", Organization: []string{"Canva"}}, ca)
+	other := newTestCertificate(t, pkix.Name{CommonName: "laptop", Organization: []string{"Canva"}}, ca)
+
+	for _, tc := range []struct {
+		name   string
+		certs  []tls.Certificate
+		path   string
+		wantOK bool
+	}{
+		{"allowed repository", []tls.Certificate{ci.tlsCertificate()}, "/canva/goblet/info/refs", true},
+		{"other repository", []tls.Certificate{ci.tlsCertificate()}, "/other/goblet/info/refs", false},
+		{"no matching rule", []tls.Certificate{other.tlsCertificate()}, "/canva/goblet/info/refs", false},
+		{"no certificate", nil, "/canva/goblet/info/refs", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: tc.certs}}}
+			res, err := client.Get(srvURL + tc.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if got := res.StatusCode == http.StatusOK; got != tc.wantOK {
+				t.Errorf("got status %d, want OK: %t", res.StatusCode, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem")
+	ca := newTestCertificate(t, pkix.Name{CommonName: "test-ca"}, nil)
+	first := newTestCertificate(t, pkix.Name{CommonName: "first"}, ca)
+	first.writePEM(t, certFile, keyFile)
+
+	reloader, err := goblet.NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replace := func(name string, modTime time.Time) {
+		newTestCertificate(t, pkix.Name{CommonName: name}, ca).writePEM(t, certFile, keyFile)
+		for _, f := range []string{certFile, keyFile} {
+			if err := os.Chtimes(f, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	served := func() string {
+		cert, err := reloader.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+
+	replace("second", time.Now().Add(time.Minute))
+	if got := served(); got != "second" {
+		t.Errorf("got certificate %s, want second", got)
+	}
+
+	// The files were just checked, so they aren't checked again right away.
+	replace("third", time.Now().Add(2*time.Minute))
+	if got := served(); got != "second" {
+		t.Errorf("got certificate %s, want second until the next check", got)
+	}
+}
@@ -0,0 +1,43 @@
+package end2end
+
+import (
+	"testing"
+
+	goblettest "github.com/canva/goblet/testing"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestFetch_Tracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		TracerProvider:    sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)),
+	})
+	defer ts.Close()
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "-c", "http.extraHeader=traceparent: 00-"+traceID+"-00f067aa0ba902b7-01", "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]bool{}
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID().String() != traceID {
+			t.Errorf("got span %s in trace %s, want %s", span.Name(), span.SpanContext().TraceID(), traceID)
+		}
+		got[span.Name()] = true
+	}
+	for _, name := range []string{"goblet.request", "authorize", "git ls-refs", "lsRefsUpstream", "git fetch", "fetchUpstreamPool queue", "fetchUpstream", "serveFetchPool queue", "upload-pack"} {
+		if !got[name] {
+			t.Errorf("span %s not recorded, got %v", name, got)
+		}
+	}
+}
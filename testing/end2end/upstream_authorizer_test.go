@@ -0,0 +1,83 @@
+package end2end
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/canva/goblet"
+	goblettest "github.com/canva/goblet/testing"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFetch_UpstreamAuthorizer(t *testing.T) {
+	store := goblet.NewMemoryAuthCache(0)
+	defer store.Close()
+
+	var authorizer *goblet.UpstreamAuthorizer
+	// The upstream accepts the client token for the info/refs probes only.
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: func(r *http.Request) error { return authorizer.RequestAuthorizer(r) },
+		TokenSource:       goblettest.TestTokenSource,
+		ClientInfoRefs:    true,
+	})
+	defer ts.Close()
+	upstream, err := url.Parse(ts.UpstreamServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizer = goblet.NewUpstreamAuthorizer(func(u *url.URL) (*url.URL, error) {
+		ret, err := goblet.DefaultURLCanonicalizer(u)
+		if err != nil {
+			return nil, err
+		}
+		ret.Scheme = upstream.Scheme
+		ret.Host = upstream.Host
+		return ret, nil
+	}, []string{upstream.Host}, goblet.NewAuthDecisionCache(store, nil, 0, 0, 0), nil)
+
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer invalid-token", "fetch", ts.ProxyServerURL); err == nil {
+		t.Fatal("fetch with a token rejected by the upstream succeeded")
+	}
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := client.Run("rev-parse", "FETCH_HEAD"); err != nil {
+		t.Error(err)
+	} else if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestUpstreamAuthorizer_HostNotAllowed(t *testing.T) {
+	var probes atomic.Int32
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+	}))
+	defer other.Close()
+
+	authorizer := goblet.NewUpstreamAuthorizer(func(u *url.URL) (*url.URL, error) {
+		return &url.URL{Scheme: u.Scheme, Host: u.Host, Path: strings.TrimSuffix(u.Path, "/info/refs")}, nil
+	}, []string{"git.example.com"}, nil, nil)
+
+	req := httptest.NewRequest(http.MethodGet, other.URL+"/owner/repo/info/refs", nil)
+	req.Header.Set("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+	if got := status.Code(authorizer.RequestAuthorizer(req)); got != codes.PermissionDenied {
+		t.Errorf("got %s, want PermissionDenied", got)
+	}
+	if got := probes.Load(); got != 0 {
+		t.Errorf("got %d requests to the host not allowed, want none", got)
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"time"
 
 	"github.com/canva/goblet"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/oauth2"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -57,6 +58,17 @@ type TestServer struct {
 	UpstreamServerURL string
 	proxyServer       *http.Server
 	ProxyServerURL    string
+	adminServer       *http.Server
+
+	// AdminServerURL serves the endpoints that goblet-server serves on its
+	// admin listener, e.g. the peer bundles.
+	AdminServerURL string
+
+	// ServerConfig is the configuration of the proxy.
+	ServerConfig *goblet.ServerConfig
+
+	credentialPassthrough bool
+	clientInfoRefs        bool
 }
 
 type TestServerConfig struct {
@@ -64,10 +76,36 @@ type TestServerConfig struct {
 	TokenSource       oauth2.TokenSource
 	ErrorReporter     func(*http.Request, error)
 	RequestLogger     func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration)
+	AuditLogger       func(*goblet.AuditEntry)
+	Metrics           goblet.Metrics
+	TracerProvider    trace.TracerProvider
+
+	// CredentialPassthrough also makes the upstream accept
+	// ValidClientAuthToken.
+	CredentialPassthrough bool
+
+	// ClientInfoRefs makes the upstream accept ValidClientAuthToken for
+	// the info/refs requests, e.g. the probes of the upstream request
+	// authorizer.
+	ClientInfoRefs bool
+
+	// Readiness enables /readyz on the proxy server. The test URL
+	// canonicalizer maps any repository URL to the upstream repository.
+	Readiness *goblet.ReadinessConfig
+
+	// PackObjectsHook, if set, caches the packs sent by the proxy in
+	// PackObjectsCache.
+	PackObjectsHook  string
+	PackObjectsCache string
+
+	// BundleDir, if set, makes the proxy serve the clone bundles of the
+	// repositories regenerated after BundleMaxAge.
+	BundleDir    string
+	BundleMaxAge time.Duration
 }
 
 func NewTestServer(config *TestServerConfig) *TestServer {
-	s := &TestServer{}
+	s := &TestServer{credentialPassthrough: config.CredentialPassthrough, clientInfoRefs: config.ClientInfoRefs}
 	{
 		s.UpstreamGitRepo = NewLocalBareGitRepo()
 		s.UpstreamGitRepo.Run("config", "http.receivepack", "1")
@@ -88,30 +126,66 @@ func NewTestServer(config *TestServerConfig) *TestServer {
 	}
 
 	{
+		readiness := config.Readiness
 		dir, err := os.MkdirTemp("", "goblet_cache")
 		if err != nil {
 			log.Fatal(err)
 		}
 		config := &goblet.ServerConfig{
-			LocalDiskCacheRoot: dir,
-			URLCanonicalizer:   s.testURLCanonicalizer,
-			RequestAuthorizer:  config.RequestAuthorizer,
-			TokenSource:        config.TokenSource,
-			ErrorReporter:      config.ErrorReporter,
-			RequestLogger:      config.RequestLogger,
+			LocalDiskCacheRoot:    dir,
+			URLCanonicalizer:      s.testURLCanonicalizer,
+			RequestAuthorizer:     config.RequestAuthorizer,
+			TokenSource:           config.TokenSource,
+			CredentialPassthrough: config.CredentialPassthrough,
+			ErrorReporter:         config.ErrorReporter,
+			RequestLogger:         config.RequestLogger,
+			AuditLogger:           config.AuditLogger,
+			Metrics:               config.Metrics,
+			TracerProvider:        config.TracerProvider,
+			PackObjectsHook:       config.PackObjectsHook,
+			PackObjectsCache:      config.PackObjectsCache,
+			BundleDir:             config.BundleDir,
+			BundleMaxAge:          config.BundleMaxAge,
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/", goblet.HTTPHandler(config))
+		mux.Handle(goblet.BundlePathPrefix, goblet.BundleHandler(config))
+		if readiness != nil {
+			mux.Handle("/readyz", goblet.ReadinessHandler(config, readiness))
 		}
 		s.proxyServer = &http.Server{
-			Handler: goblet.HTTPHandler(config),
+			Handler: mux,
 		}
 
 		l, err := net.Listen("tcp4", ":0")
 		if err != nil {
 			log.Fatal(err)
 		}
+		s.ProxyServerURL = fmt.Sprintf("http://%s/", l.Addr().String())
+		if config.BundleDir != "" {
+			config.BundleURL = s.ProxyServerURL
+		}
 		go func() {
 			s.proxyServer.Serve(l)
 		}()
-		s.ProxyServerURL = fmt.Sprintf("http://%s/", l.Addr().String())
+		s.ServerConfig = config
+
+		adminMux := http.NewServeMux()
+		adminMux.Handle(goblet.PeerBundlePath, goblet.PeerBundleHandler(config))
+		adminMux.Handle("/status", goblet.StatusHandler(config, nil))
+		adminMux.Handle("/operations", goblet.OperationsHandler())
+		adminMux.Handle("/operations/events", goblet.OperationEventsHandler())
+		s.adminServer = &http.Server{
+			Handler: adminMux,
+		}
+		adminListener, err := net.Listen("tcp4", ":0")
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			s.adminServer.Serve(adminListener)
+		}()
+		s.AdminServerURL = fmt.Sprintf("http://%s/", adminListener.Addr().String())
 	}
 	return s
 }
@@ -136,11 +210,20 @@ func (s *TestServer) testURLCanonicalizer(u *url.URL) (*url.URL, error) {
 }
 
 func (s *TestServer) upstreamServerHandler(w http.ResponseWriter, req *http.Request) {
-	if req.Header.Get("Authorization") != "Bearer "+validServerAuthToken {
+	authzHeader := req.Header.Get("Authorization")
+	clientAllowed := s.credentialPassthrough || (s.clientInfoRefs && req.Method == http.MethodGet && strings.HasSuffix(req.URL.Path, "/info/refs"))
+	if authzHeader != "Bearer "+validServerAuthToken && !(clientAllowed && authzHeader == "Bearer "+ValidClientAuthToken) {
 		http.Error(w, "invalid authenticator", http.StatusForbidden)
 		return
 	}
 
+	// The upstream repository is served under any path.
+	for _, suffix := range []string{"/info/refs", "/git-upload-pack", "/git-receive-pack"} {
+		if strings.HasSuffix(req.URL.Path, suffix) {
+			req.URL.Path = suffix
+		}
+	}
+
 	h := &cgi.Handler{
 		Path: gitBinary,
 		Dir:  string(s.UpstreamGitRepo),
@@ -180,6 +263,7 @@ func (s *TestServer) CreateRandomCommitUpstream() (string, error) {
 func (s *TestServer) Close() {
 	s.upstreamServer.Close()
 	s.proxyServer.Close()
+	s.adminServer.Close()
 	s.UpstreamGitRepo.Close()
 }
 
@@ -0,0 +1,173 @@
+package goblet
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// certificateCheckInterval is the minimum interval between two checks of the
+// certificate and key files for changes.
+const certificateCheckInterval = 10 * time.Second
+
+// CertificateReloader serves a TLS certificate and key from files, and reloads
+// them when they change on disk, e.g. after a renewal.
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.Mutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	lastCheck   time.Time
+}
+
+// NewCertificateReloader returns a CertificateReloader with the certificate
+// loaded.
+func NewCertificateReloader(certFile, keyFile string) (*CertificateReloader, error) {
+	r := &CertificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reloadLocked(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate is meant to be tls.Config.GetCertificate. The files are
+// checked for changes at most every certificateCheckInterval. If they cannot
+// be reloaded, the certificate loaded last keeps being served.
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.lastCheck) < certificateCheckInterval {
+		return r.cert, nil
+	}
+	r.lastCheck = time.Now()
+	certInfo, certErr := os.Stat(r.certFile)
+	keyInfo, keyErr := os.Stat(r.keyFile)
+	if certErr == nil && keyErr == nil && (!certInfo.ModTime().Equal(r.certModTime) || !keyInfo.ModTime().Equal(r.keyModTime)) {
+		if err := r.reloadLocked(); err != nil {
+			Logger(LogAuth).Error("TLS certificate reload failed, keeping the current one", "err", err)
+		} else {
+			Logger(LogAuth).Info("Reloaded the TLS certificate", "cert", r.certFile, "key", r.keyFile)
+		}
+	}
+	return r.cert, nil
+}
+
+func (r *CertificateReloader) reloadLocked() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.cert = &cert
+	r.certModTime = certInfo.ModTime()
+	r.keyModTime = keyInfo.ModTime()
+	return nil
+}
+
+// NewServerTLSConfig returns the TLS configuration of an HTTPS listener
+// serving the certificate of reloader. If clientCAFile is set, clients can
+// present a certificate issued by one of its CAs, and must do so if
+// requireClientCert is set.
+func NewServerTLSConfig(reloader *CertificateReloader, clientCAFile string, requireClientCert bool) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if clientCAFile == "" {
+		return config, nil
+	}
+
+	bs, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bs) {
+		return nil, fmt.Errorf("no CA certificate found in %s", clientCAFile)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if requireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ClientCertificateRule allows the clients whose verified certificate subject
+// matches Subject to fetch the repositories matching Repositories. Subject is
+// a path.Match pattern of the RFC 2253 form of the subject, e.g.
+// "CN=ci-*,O=Canva". Repositories are path.Match patterns of "<host>/<path>"
+// of the canonical upstream URL, e.g. "github.com/canva/*".
+type ClientCertificateRule struct {
+	Subject      string
+	Repositories []string
+}
+
+// NewClientCertificateRequestAuthorizer returns a request authorizer that
+// decides on the requests made with a verified client certificate matching one
+// of the rules. The other requests are decided by next.
+func NewClientCertificateRequestAuthorizer(rules []ClientCertificateRule, urlCanonicalizer func(*url.URL) (*url.URL, error), next func(*http.Request) error) func(*http.Request) error {
+	return func(request *http.Request) error {
+		subject, ok := clientCertificateSubject(request)
+		if !ok {
+			return next(request)
+		}
+
+		var matching []ClientCertificateRule
+		for _, rule := range rules {
+			if matched, _ := path.Match(rule.Subject, subject); matched {
+				matching = append(matching, rule)
+			}
+		}
+		if len(matching) == 0 {
+			return next(request)
+		}
+
+		u, err := urlCanonicalizer(request.URL)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "cannot canonicalize the URL: %v", err)
+		}
+		repository := strings.ToLower(u.Host + u.Path)
+		for _, rule := range matching {
+			for _, pattern := range rule.Repositories {
+				if matched, _ := path.Match(strings.ToLower(pattern), repository); matched {
+					SetPrincipal(request, "cert:"+subject)
+					return nil
+				}
+			}
+		}
+		Logger(LogAuth).Info("Client certificate not allowed to fetch the repository", "repo", u.String(), "subject", subject)
+		return status.Error(codes.PermissionDenied, "access denied")
+	}
+}
+
+// clientCertificateSubject returns the subject of the client certificate, if
+// the client presented one that the TLS handshake verified.
+func clientCertificateSubject(request *http.Request) (string, bool) {
+	if request.TLS == nil || len(request.TLS.VerifiedChains) == 0 || len(request.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	return request.TLS.VerifiedChains[0][0].Subject.String(), true
+}
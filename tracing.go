@@ -0,0 +1,44 @@
+package goblet
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/canva/goblet"
+
+// traceContext reads the W3C traceparent header of the inbound requests, so
+// that their spans join the trace of the client, e.g. a CI job.
+var traceContext = propagation.TraceContext{}
+
+var (
+	dirKey       = attribute.Key("goblet.dir")
+	principalKey = attribute.Key("goblet.principal")
+	ciSourceKey  = attribute.Key("goblet.ci_source")
+)
+
+func (c *ServerConfig) tracer() trace.Tracer {
+	if c.TracerProvider == nil {
+		return trace.NewNoopTracerProvider().Tracer(instrumentationName)
+	}
+	return c.TracerProvider.Tracer(instrumentationName)
+}
+
+// startSpan starts a span of the work done on r.
+func (r *managedRepository) startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	opts = append(opts, trace.WithAttributes(dirKey.String(r.localDiskPath)))
+	return r.config.tracer().Start(ctx, name, opts...)
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+	span.End()
+}
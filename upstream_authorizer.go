@@ -0,0 +1,127 @@
+package goblet
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// UpstreamAuthorizer authorizes requests by replaying the client's
+// Authorization header against the upstream repository's info/refs. It works
+// with any Git hosting provider that serves the smart HTTP protocol, e.g.
+// GitLab or Bitbucket.
+type UpstreamAuthorizer struct {
+	urlCanonicalizer func(*url.URL) (*url.URL, error)
+	hosts            map[string]bool
+	cache            *AuthDecisionCache
+	metrics          Metrics
+}
+
+// NewUpstreamAuthorizer returns an UpstreamAuthorizer that resolves the
+// upstream of a request with urlCanonicalizer, and caches the decisions in
+// cache unless it is nil. metrics can be nil.
+//
+// Only the upstreams on hosts (e.g. "gitlab.example.com", or
+// "git.example.com:8443") are probed: the requests for the other hosts are
+// denied, so that the clients cannot make the server send their credential,
+// and then its own, to a server of their choice.
+func NewUpstreamAuthorizer(urlCanonicalizer func(*url.URL) (*url.URL, error), hosts []string, cache *AuthDecisionCache, metrics Metrics) *UpstreamAuthorizer {
+	if metrics == nil {
+		metrics = NoopMetrics{}
+	}
+	allowed := map[string]bool{}
+	for _, host := range hosts {
+		allowed[strings.ToLower(host)] = true
+	}
+	return &UpstreamAuthorizer{
+		urlCanonicalizer: urlCanonicalizer,
+		hosts:            allowed,
+		cache:            cache,
+		metrics:          metrics,
+	}
+}
+
+func (a *UpstreamAuthorizer) RequestAuthorizer(req *http.Request) error {
+	authzHeader := req.Header.Get("Authorization")
+	if authzHeader == "" {
+		return status.Error(codes.Unauthenticated, "request not authenticated")
+	}
+
+	u, err := a.urlCanonicalizer(req.URL)
+	if err != nil {
+		a.metrics.Count("goblet.authentication.failed", 1, []string{"reason:malformed_url"})
+		return status.Errorf(codes.InvalidArgument, "cannot canonicalize the URL: %v", err)
+	}
+	if !a.hosts[strings.ToLower(u.Host)] {
+		Logger(LogAuth).Info("Upstream host not allowed", "repo", u.String())
+		a.metrics.Count("goblet.authentication.failed", 1, []string{"reason:host_not_allowed"})
+		return status.Error(codes.PermissionDenied, "access denied")
+	}
+
+	authorized, err := a.isAuthorized(authzHeader, u.String())
+	if !authorized {
+		if err != nil {
+			Logger(LogAuth).Info("Authentication error", "repo", u.String(), "err", err)
+		}
+		a.metrics.Count("goblet.authentication.failed", 1, []string{"reason:access_denied"})
+		return status.Error(codes.PermissionDenied, "access denied")
+	}
+
+	// Ensures that the credential isn't leaked further down the chain.
+	req.Header.Del("Authorization")
+	SetPrincipal(req, "upstream:"+CredentialFingerprint(authzHeader))
+	return nil
+}
+
+func (a *UpstreamAuthorizer) isAuthorized(authzHeader, upstreamURL string) (bool, error) {
+	validate := func() (bool, bool, error) {
+		a.metrics.Count("goblet.operation.count", 1, []string{"op:token_validation"})
+		return probeUpstream(authzHeader, upstreamURL)
+	}
+	if a.cache == nil {
+		authorized, _, err := validate()
+		return authorized, err
+	}
+	return a.cache.Authorize(authzHeader, upstreamURL, validate)
+}
+
+// probeUpstream checks whether authzHeader grants access to the repository at
+// upstreamURL. Like the GitHub authorizer, it returns whether the client is
+// authorized, whether the result should be cached, and the associated error.
+// Network and upstream server errors aren't cached so that the next request
+// retries.
+func probeUpstream(authzHeader, upstreamURL string) (bool, bool, error) {
+	infoRefsURL := upstreamURL + "/info/refs?service=git-upload-pack"
+
+	req, err := http.NewRequest(http.MethodGet, infoRefsURL, nil)
+	if err != nil {
+		return false, true, err
+	}
+	req.Header.Add("Git-Protocol", "version=2")
+	req.Header.Add("Authorization", authzHeader)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		Logger(LogAuth).Error("Upstream authorization request failed", "url", infoRefsURL, "err", err)
+		return false, false, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		bs, _ := io.ReadAll(io.LimitReader(res.Body, 200))
+		Logger(LogAuth).Info("Upstream authorization failed with a non-OK response", "url", infoRefsURL, "status", res.StatusCode, "body_preview", string(bs))
+		err := errors.New(string(bs))
+		if res.StatusCode >= 500 && res.StatusCode < 600 && res.StatusCode != 501 {
+			return false, false, err
+		}
+		return false, true, err
+	}
+	// Drain the advertisement so that the connection can be reused.
+	io.Copy(io.Discard, res.Body)
+	return true, true, nil
+}